@@ -0,0 +1,58 @@
+// webchat-migrate moves the keys of webchat in redis under the prefix given by
+// REDIS_PREFIX, "webchat:" by default, e.g. from the versions which had no prefix.
+// The chat servers must be stopped meanwhile.
+//
+// It connects to redis like webchat, with REDIS_URL, or REDIS_ADDR and REDIS_PASSWORD.
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/nouney/fluxracine/internal/db/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	var opts redis.MigrateOptions
+	flag.StringVar(&opts.From, "from", "", "prefix of the keys to move")
+	flag.BoolVar(&opts.DropLegacy, "drop-legacy", false, "delete the sessions stored under bare nicknames by the oldest versions")
+	flag.BoolVar(&opts.MoveLegacy, "move-legacy", false, "move the sessions stored under bare nicknames by the oldest versions to the sessions of the users")
+	flag.BoolVar(&opts.ConfirmUnprefixed, "confirm-unprefixed", false, "confirm -drop-legacy or -move-legacy without -from, on the keys without prefix")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "only log the changes")
+	flag.Parse()
+
+	var (
+		cfg *redis.Config
+		err error
+	)
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		cfg, err = redis.ParseURL(redisURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		redisAddr := os.Getenv("REDIS_ADDR")
+		if redisAddr == "" {
+			log.Fatal("REDIS_URL or REDIS_ADDR is missing")
+		}
+		cfg = &redis.Config{Addrs: []string{redisAddr}, Password: os.Getenv("REDIS_PASSWORD")}
+	}
+	if prefix := os.Getenv("REDIS_PREFIX"); prefix != "" {
+		cfg.Prefix = prefix
+	}
+
+	db, err := redis.NewFromConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	stats, err := db.MigrateKeys(opts)
+	if stats != nil {
+		log.Infof("%d keys moved, %d skipped, %d dropped, %d ignored", stats.Moved, stats.Skipped, stats.Dropped, stats.Ignored)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
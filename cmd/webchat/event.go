@@ -13,17 +13,44 @@ import (
 )
 
 const (
-	actionSendMessage    = "send_message"
-	actionReceiveMessage = "receive_message"
+	actionSendMessage        = "send_message"
+	actionReceiveMessage     = "receive_message"
+	actionError              = "error"
+	actionCreateRoom         = "create_room"
+	actionJoinRoom           = "join_room"
+	actionLeaveRoom          = "leave_room"
+	actionListRoomMembers    = "list_room_members"
+	actionRoomMembers        = "room_members"
+	actionSendRoomMessage    = "send_room_message"
+	actionReceiveRoomMessage = "receive_room_message"
+	actionGetHistory         = "get_history"
+	actionHistory            = "history"
+	actionSetPresence        = "set_presence"
+	actionWatchPresence      = "watch_presence"
+	actionUnwatchPresence    = "unwatch_presence"
+	actionPresence           = "presence"
+	actionMessageSent        = "message_sent"
+	actionReadMessage        = "read_message"
+	actionReceipt            = "receipt"
+	actionTyping             = "typing"
+	actionReconnect          = "reconnect"
+	actionLogin              = "login"
 )
 
 type websocketEventSource struct {
 	conn *websocket.Conn
+	// set once the login of the user has been emitted
+	loggedIn bool
 }
 
 // beware: websocket.Conn supports max 1 reading goroutine and 1 writing goroutine.
 // the reading one is below and used by the event dispatcher.
-func (ws websocketEventSource) Next() (*event.Event, error) {
+// The first event is the login of the user, before anything is read.
+func (ws *websocketEventSource) Next() (*event.Event, error) {
+	if !ws.loggedIn {
+		ws.loggedIn = true
+		return &event.Event{Type: event.EventUserLogin}, nil
+	}
 	ev := event.Event{}
 	_, msg, err := ws.conn.ReadMessage()
 	if err != nil {
@@ -45,6 +72,28 @@ func (ws websocketEventSource) Next() (*event.Event, error) {
 	switch action {
 	case actionSendMessage:
 		ev.Type = event.EventUserSendMessage
+	case actionCreateRoom:
+		ev.Type = event.EventUserCreateRoom
+	case actionJoinRoom:
+		ev.Type = event.EventUserJoinRoom
+	case actionLeaveRoom:
+		ev.Type = event.EventUserLeaveRoom
+	case actionListRoomMembers:
+		ev.Type = event.EventUserListRoomMembers
+	case actionSendRoomMessage:
+		ev.Type = event.EventUserSendRoomMessage
+	case actionGetHistory:
+		ev.Type = event.EventUserGetHistory
+	case actionSetPresence:
+		ev.Type = event.EventUserSetPresence
+	case actionWatchPresence:
+		ev.Type = event.EventUserWatchPresence
+	case actionUnwatchPresence:
+		ev.Type = event.EventUserUnwatchPresence
+	case actionReadMessage:
+		ev.Type = event.EventUserReadMessage
+	case actionTyping:
+		ev.Type = event.EventUserTyping
 	default:
 		return nil, fmt.Errorf("unknown action: %s", action)
 	}
@@ -53,14 +102,45 @@ func (ws websocketEventSource) Next() (*event.Event, error) {
 
 type chatSessionEventSource struct {
 	sess *chat.Session
+	conn *websocket.Conn
 }
 
 func (cses chatSessionEventSource) Next() (*event.Event, error) {
 	m, err := cses.sess.ReceiveMessage()
+	if err == chat.ErrSlowConsumer {
+		// closing the websocket stops the other source, which logs the user out
+		log.Warnf("user \"%s\" is too slow, disconnect him", cses.sess.Nickname)
+		cses.conn.Close()
+		return nil, io.EOF
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if m.Reconnect != nil {
+		return &event.Event{
+			Type: event.EventUserReceiveReconnect,
+			Data: m.Reconnect,
+		}, nil
+	}
+	if m.Signal != nil {
+		return &event.Event{
+			Type: event.EventUserReceiveTyping,
+			Data: m,
+		}, nil
+	}
+	if m.Receipt != nil {
+		return &event.Event{
+			Type: event.EventUserReceiveReceipt,
+			Data: m.Receipt,
+		}, nil
+	}
+	if m.Presence != nil {
+		return &event.Event{
+			Type: event.EventUserReceivePresence,
+			Data: m.Presence,
+		}, nil
+	}
 	return &event.Event{
 		Type: event.EventUserReceiveMessage,
 		Data: m,
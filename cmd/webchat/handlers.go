@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"html/template"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/nouney/fluxracine/internal/db"
 	"github.com/nouney/fluxracine/pkg/chat"
 	"github.com/nouney/fluxracine/pkg/event"
 	"github.com/pkg/errors"
@@ -17,9 +20,17 @@ type messagePayload struct {
 	Message string `json:"message"`
 }
 
+type messageSentData struct {
+	ID string `json:"id"`
+	To string `json:"to"`
+}
+
 // handleEventUserSendMessage handles the sending of a message to a user
-func handleEventUserSendMessage(sess *chat.Session) event.Handler {
+func handleEventUserSendMessage(ctx context.Context, sess *chat.Session, c *websocket.Conn) event.Handler {
 	return func(data interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
 		payload := &messagePayload{}
 		err := json.Unmarshal(data.([]byte), &payload)
 		if err != nil {
@@ -27,49 +38,583 @@ func handleEventUserSendMessage(sess *chat.Session) event.Handler {
 		}
 
 		log.Printf("user \"%s\" send \"%s\" to \"%s\"", sess.Nickname, payload.Message, payload.To)
-		err = sess.SendMessage(payload.To, payload.Message)
+		id, err := sess.SendMessage(ctx, payload.To, payload.Message)
 		if err != nil {
 			return errors.Wrap(err, "send message")
 		}
+		return c.WriteJSON(&action{
+			Action: actionMessageSent,
+			Data: &messageSentData{
+				ID: id,
+				To: payload.To,
+			},
+		})
+	}
+}
+
+type readMessagePayload struct {
+	ID   string `json:"id"`
+	From string `json:"from"`
+}
+
+// handleEventUserReadMessage sends a read receipt to the sender of a message
+func handleEventUserReadMessage(ctx context.Context, sess *chat.Session, c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
+		payload := &readMessagePayload{}
+		err := json.Unmarshal(data.([]byte), &payload)
+		if err != nil {
+			return errors.Wrap(err, "json unmarshal")
+		}
+
+		err = sess.MessageRead(ctx, payload.From, payload.ID)
+		if err != nil {
+			return reportError(c, errors.Wrap(err, "read receipt"))
+		}
 		return nil
 	}
 }
 
+type receiptData struct {
+	ID     string `json:"id"`
+	By     string `json:"by"`
+	Status string `json:"status"`
+}
+
+// handleEventUserReceiveReceipt handles the reception of a receipt for a message sent by the user
+func handleEventUserReceiveReceipt(c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		r := data.(*chat.Receipt)
+		return c.WriteJSON(&action{
+			Action: actionReceipt,
+			Data: &receiptData{
+				ID:     r.MessageID,
+				By:     r.By,
+				Status: string(r.Status),
+			},
+		})
+	}
+}
+
+// typing states sent and received by the browser
+const (
+	typingStarted = "started"
+	typingStopped = "stopped"
+)
+
+type typingPayload struct {
+	To    string `json:"to"`
+	State string `json:"state"`
+}
+
+type typingData struct {
+	From  string `json:"from"`
+	State string `json:"state"`
+}
+
+// handleEventUserTyping handles the typing indicator sent by the user
+func handleEventUserTyping(ctx context.Context, sess *chat.Session, c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
+		payload := &typingPayload{}
+		err := json.Unmarshal(data.([]byte), &payload)
+		if err != nil {
+			return errors.Wrap(err, "json unmarshal")
+		}
+
+		kind := chat.SignalKind("")
+		switch payload.State {
+		case typingStarted:
+			kind = chat.SignalTypingStarted
+		case typingStopped:
+			kind = chat.SignalTypingStopped
+		}
+		err = sess.SendSignal(ctx, payload.To, kind)
+		if err != nil {
+			return reportError(c, errors.Wrap(err, "typing"))
+		}
+		return nil
+	}
+}
+
+// handleEventUserReceiveTyping handles the typing indicator of someone writing to the user
+func handleEventUserReceiveTyping(c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		m := data.(*chat.MessagePayload)
+		state := typingStarted
+		if m.Signal.Kind == chat.SignalTypingStopped {
+			state = typingStopped
+		}
+		return c.WriteJSON(&action{
+			Action: actionTyping,
+			Data: &typingData{
+				From:  m.From,
+				State: state,
+			},
+		})
+	}
+}
+
+type reconnectData struct {
+	Nickname string `json:"nickname"`
+	// Delay is in milliseconds
+	Delay int64 `json:"delay"`
+}
+
+// handleEventUserReceiveReconnect handles the request of the server to reconnect elsewhere
+func handleEventUserReceiveReconnect(sess *chat.Session, c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		r := data.(*chat.Reconnect)
+		return c.WriteJSON(&action{
+			Action: actionReconnect,
+			Data: &reconnectData{
+				Nickname: sess.Nickname,
+				Delay:    int64(r.Delay / time.Millisecond),
+			},
+		})
+	}
+}
+
 type action struct {
 	Action string      `json:"action"`
 	Data   interface{} `json:"data"`
 }
 
 type receiveMessageData struct {
+	ID      string `json:"id"`
+	Seq     uint64 `json:"seq,omitempty"`
+	Stream  string `json:"stream,omitempty"`
 	From    string `json:"from"`
+	To      string `json:"to"`
 	Message string `json:"message"`
+	// Echo is set if the message has been sent by the user from another session
+	Echo bool `json:"echo,omitempty"`
+}
+
+type getHistoryPayload struct {
+	Peer   string `json:"peer"`
+	Room   string `json:"room"`
+	Before int64  `json:"before"`
+	Limit  int    `json:"limit"`
+}
+
+type historyMessage struct {
+	ID int64 `json:"id"`
+	// MessageID, Seq and Stream are the ones of the message when it was sent
+	MessageID string    `json:"message_id,omitempty"`
+	Seq       uint64    `json:"seq,omitempty"`
+	Stream    string    `json:"stream,omitempty"`
+	From      string    `json:"from"`
+	To        string    `json:"to,omitempty"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+type historyData struct {
+	Peer     string            `json:"peer,omitempty"`
+	Room     string            `json:"room,omitempty"`
+	Messages []*historyMessage `json:"messages"`
+}
+
+// handleEventUserGetHistory sends a page of the history of a conversation (with a peer or in a room)
+func handleEventUserGetHistory(ctx context.Context, sess *chat.Session, c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
+		payload := &getHistoryPayload{}
+		err := json.Unmarshal(data.([]byte), &payload)
+		if err != nil {
+			return errors.Wrap(err, "json unmarshal")
+		}
+
+		var msgs []*db.Message
+		if payload.Room != "" {
+			msgs, err = sess.RoomHistory(ctx, payload.Room, payload.Before, payload.Limit)
+		} else {
+			msgs, err = sess.History(ctx, payload.Peer, payload.Before, payload.Limit)
+		}
+		if err != nil {
+			return reportError(c, errors.Wrap(err, "history"))
+		}
+
+		hd := &historyData{
+			Peer:     payload.Peer,
+			Room:     payload.Room,
+			Messages: make([]*historyMessage, 0, len(msgs)),
+		}
+		for _, m := range msgs {
+			hd.Messages = append(hd.Messages, &historyMessage{
+				ID:        m.ID,
+				MessageID: m.MessageID,
+				Seq:       m.Seq,
+				Stream:    m.Stream,
+				From:      m.From,
+				To:        m.To,
+				Message:   m.Text,
+				Time:      m.Time,
+			})
+		}
+		return c.WriteJSON(&action{
+			Action: actionHistory,
+			Data:   hd,
+		})
+	}
+}
+
+type setPresencePayload struct {
+	Status string `json:"status"`
+}
+
+type watchPresencePayload struct {
+	Nicknames []string `json:"nicknames"`
+}
+
+type presenceData struct {
+	Nickname string    `json:"nickname"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// writePresence sends the presence of a user to the browser
+func writePresence(c *websocket.Conn, p *chat.PresenceUpdate) error {
+	return c.WriteJSON(&action{
+		Action: actionPresence,
+		Data: &presenceData{
+			Nickname: p.Nickname,
+			Status:   string(p.Status),
+			LastSeen: p.LastSeen,
+		},
+	})
+}
+
+// handleEventUserSetPresence handles the change of the presence status of the user
+func handleEventUserSetPresence(ctx context.Context, sess *chat.Session, c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
+		payload := &setPresencePayload{}
+		err := json.Unmarshal(data.([]byte), &payload)
+		if err != nil {
+			return errors.Wrap(err, "json unmarshal")
+		}
+
+		err = sess.SetPresence(ctx, chat.PresenceStatus(payload.Status))
+		if err != nil {
+			return reportError(c, errors.Wrap(err, "set presence"))
+		}
+		return nil
+	}
+}
+
+// handleEventUserWatchPresence subscribes the user to the presence of others
+// and sends him their current presence
+func handleEventUserWatchPresence(ctx context.Context, sess *chat.Session, c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		payload := &watchPresencePayload{}
+		err := json.Unmarshal(data.([]byte), &payload)
+		if err != nil {
+			return errors.Wrap(err, "json unmarshal")
+		}
+
+		updates, err := sess.WatchPresence(ctx, payload.Nicknames)
+		if err != nil {
+			return reportError(c, errors.Wrap(err, "watch presence"))
+		}
+		for _, p := range updates {
+			err = writePresence(c, p)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// handleEventUserUnwatchPresence unsubscribes the user from the presence of others
+func handleEventUserUnwatchPresence(ctx context.Context, sess *chat.Session, c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		payload := &watchPresencePayload{}
+		err := json.Unmarshal(data.([]byte), &payload)
+		if err != nil {
+			return errors.Wrap(err, "json unmarshal")
+		}
+
+		err = sess.UnwatchPresence(ctx, payload.Nicknames)
+		if err != nil {
+			return reportError(c, errors.Wrap(err, "unwatch presence"))
+		}
+		return nil
+	}
+}
+
+// handleEventUserReceivePresence handles the presence change of a watched user
+func handleEventUserReceivePresence(c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		return writePresence(c, data.(*chat.PresenceUpdate))
+	}
 }
 
 // handleEventUserReceiveMessage handles the reception of a message for a user
-func handleEventUserReceiveMessage(sess *chat.Session, c *websocket.Conn) event.Handler {
+func handleEventUserReceiveMessage(ctx context.Context, sess *chat.Session, c *websocket.Conn) event.Handler {
 	return func(data interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
 		log.Infof("user \"%s\" receive a message: %+v", sess.Nickname, data)
 		msg := data.(*chat.MessagePayload)
-		return c.WriteJSON(&action{
+		if msg.Room != "" {
+			return c.WriteJSON(&action{
+				Action: actionReceiveRoomMessage,
+				Data: &receiveRoomMessageData{
+					Room:    msg.Room,
+					From:    msg.From,
+					Message: msg.Message,
+				},
+			})
+		}
+		err := c.WriteJSON(&action{
 			Action: actionReceiveMessage,
 			Data: &receiveMessageData{
+				ID:      msg.ID,
+				Seq:     msg.Seq,
+				Stream:  msg.Stream,
 				From:    msg.From,
+				To:      msg.To,
 				Message: msg.Message,
+				Echo:    msg.From == sess.Nickname && msg.To != sess.Nickname,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		err = sess.MessageDelivered(ctx, msg)
+		if err != nil {
+			return errors.Wrap(err, "delivery receipt")
+		}
+		return nil
+	}
+}
+
+type errorData struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// userErrorCodes maps the errors caused by the user to the codes sent to the browser
+var userErrorCodes = map[error]string{
+	chat.ErrUnauthenticated:  "unauthenticated",
+	chat.ErrNicknameTaken:    "nickname_taken",
+	chat.ErrInvalidNickname:  "invalid_nickname",
+	chat.ErrRoomNotFound:     "room_not_found",
+	chat.ErrRoomExists:       "room_exists",
+	chat.ErrNotRoomMember:    "not_room_member",
+	chat.ErrInvalidRoomName:  "invalid_room_name",
+	chat.ErrHistoryDisabled:  "history_disabled",
+	chat.ErrPresenceDisabled: "presence_disabled",
+	chat.ErrInvalidPresence:  "invalid_presence",
+	chat.ErrInvalidSignal:    "invalid_signal",
+	chat.ErrDraining:         "draining",
+	chat.ErrUnknownMessage:   "unknown_message",
+}
+
+const errorCodeInternal = "internal"
+
+// writeError sends an error to the browser.
+func writeError(c *websocket.Conn, code, msg string) error {
+	return c.WriteJSON(&action{
+		Action: actionError,
+		Data: &errorData{
+			Code:    code,
+			Message: msg,
+		},
+	})
+}
+
+// reportError sends err to the browser if it has been caused by the user.
+// Other errors are returned as is.
+func reportError(c *websocket.Conn, err error) error {
+	code, ok := userErrorCodes[errors.Cause(err)]
+	if !ok {
+		return err
+	}
+	return writeError(c, code, err.Error())
+}
+
+type roomPayload struct {
+	Room string `json:"room"`
+}
+
+type roomMessagePayload struct {
+	Room    string `json:"room"`
+	Message string `json:"message"`
+}
+
+type roomMembersData struct {
+	Room    string   `json:"room"`
+	Members []string `json:"members"`
+}
+
+type receiveRoomMessageData struct {
+	Room    string `json:"room"`
+	From    string `json:"from"`
+	Message string `json:"message"`
+}
+
+// handleEventUserRoom handles an action on a room (create, join, leave)
+func handleEventUserRoom(ctx context.Context, c *websocket.Conn, do func(ctx context.Context, room string) error) event.Handler {
+	return func(data interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
+		payload := &roomPayload{}
+		err := json.Unmarshal(data.([]byte), &payload)
+		if err != nil {
+			return errors.Wrap(err, "json unmarshal")
+		}
+
+		err = do(ctx, payload.Room)
+		if err != nil {
+			return reportError(c, err)
+		}
+		return nil
+	}
+}
+
+// handleEventUserListRoomMembers sends the members of a room to the user
+func handleEventUserListRoomMembers(ctx context.Context, sess *chat.Session, c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
+		payload := &roomPayload{}
+		err := json.Unmarshal(data.([]byte), &payload)
+		if err != nil {
+			return errors.Wrap(err, "json unmarshal")
+		}
+
+		members, err := sess.RoomMembers(ctx, payload.Room)
+		if err != nil {
+			return reportError(c, err)
+		}
+		return c.WriteJSON(&action{
+			Action: actionRoomMembers,
+			Data: &roomMembersData{
+				Room:    payload.Room,
+				Members: members,
 			},
 		})
 	}
 }
 
+// handleEventUserSendRoomMessage handles the sending of a message to a room
+func handleEventUserSendRoomMessage(ctx context.Context, sess *chat.Session, c *websocket.Conn) event.Handler {
+	return func(data interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
+		payload := &roomMessagePayload{}
+		err := json.Unmarshal(data.([]byte), &payload)
+		if err != nil {
+			return errors.Wrap(err, "json unmarshal")
+		}
+
+		log.Printf("user \"%s\" send \"%s\" to room \"%s\"", sess.Nickname, payload.Message, payload.Room)
+		err = sess.SendRoomMessage(ctx, payload.Room, payload.Message)
+		if err != nil {
+			return reportError(c, errors.Wrap(err, "send room message"))
+		}
+		return nil
+	}
+}
+
+// handleEventUserLogin handles user connection: the user is reported online.
+func handleEventUserLogin(ctx context.Context, sess *chat.Session) event.Handler {
+	return func(data interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
+		log.Infof("user \"%s\" logged in", sess.Nickname)
+		err := sess.SetPresence(ctx, chat.PresenceOnline)
+		if err != nil && err != chat.ErrPresenceDisabled {
+			return errors.Wrap(err, "set presence")
+		}
+		return nil
+	}
+}
+
 // handleEventUserLogout handles user disconnection.
-func handleEventUserLogout(sess *chat.Session) event.Handler {
+func handleEventUserLogout(ctx context.Context, sess *chat.Session) event.Handler {
 	return func(data interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
 		log.Infof("user \"%s\" logged out", sess.Nickname)
-		return sess.Close()
+		return server.CloseSession(ctx, sess)
+	}
+}
+
+type loginPayload struct {
+	Nickname string `json:"nickname"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+// readLogin reads the first frame of the websocket, which holds the nickname and the
+// credentials of the user. Browsers cannot set headers on websockets, and the query
+// of the URL ends up in the logs.
+func readLogin(c *websocket.Conn) (*loginPayload, error) {
+	c.SetReadDeadline(time.Now().Add(requestTimeout))
+	_, msg, err := c.ReadMessage()
+	if err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+	c.SetReadDeadline(time.Time{})
+
+	login := &loginPayload{}
+	a := &action{Data: login}
+	err = json.Unmarshal(msg, a)
+	if err != nil {
+		return nil, errors.Wrap(err, "json unmarshal")
 	}
+	if a.Action != actionLogin {
+		return nil, errors.Errorf("unexpected action \"%s\"", a.Action)
+	}
+	return login, nil
+}
+
+// withCredentials returns a copy of r with the credentials of the login set in its
+// headers, as a client able to set them would do.
+func (l *loginPayload) withCredentials(r *http.Request) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		r2.Header[k] = v
+	}
+	if l.Password != "" {
+		r2.SetBasicAuth(l.Nickname, l.Password)
+	}
+	if l.Token != "" {
+		r2.Header.Set("Authorization", "Bearer "+l.Token)
+	}
+	return r2
 }
 
 // handleChatSession handles a chat session via a websocket.
 func handleChatSession(w http.ResponseWriter, r *http.Request) {
+	// the load balancer sends the client to another server
+	if server.Draining() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, chat.ErrDraining.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Error(errors.Wrap(err, "upgrader"))
@@ -77,21 +622,57 @@ func handleChatSession(w http.ResponseWriter, r *http.Request) {
 	}
 	defer c.Close()
 
-	sess, err := server.NewSession()
+	login, err := readLogin(c)
 	if err != nil {
-		log.Error(errors.Wrap(err, "new session"))
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(errors.Wrap(err, "login"))
+		return
+	}
+	// without authentication, the user chooses his nickname
+	nickname, err := server.Authenticate(login.withCredentials(r), login.Nickname)
+	if err == nil && nickname == "" {
+		nickname = login.Nickname
+	}
+	// the calls to the chat server are bound to the connection
+	ctx := r.Context()
+	var sess *chat.Session
+	if err == nil {
+		newCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		sess, err = server.NewSession(newCtx, nickname)
+		cancel()
+	}
+	if err != nil {
+		err = reportError(c, err)
+		if err != nil {
+			log.Error(errors.Wrap(err, "new session"))
+			writeError(c, errorCodeInternal, "cannot create session")
+		}
 		return
 	}
 
-	log.Infof("user \"%s\" logged in", sess.Nickname)
+	sess.SetRemoteAddr(r.RemoteAddr)
 	log.Debugf("nb sessions: %d", server.NbSessions())
 
 	// Use the websocket and the chat server as event sources
-	d := event.NewDispatcher(&websocketEventSource{c}, &chatSessionEventSource{sess})
-	d.Handle(event.EventUserSendMessage, handleEventUserSendMessage(sess))
-	d.Handle(event.EventUserReceiveMessage, handleEventUserReceiveMessage(sess, c))
-	d.Handle(event.EventUserLogout, handleEventUserLogout(sess))
+	d := event.NewDispatcher(&websocketEventSource{conn: c}, &chatSessionEventSource{sess, c})
+	d.Handle(event.EventUserLogin, handleEventUserLogin(ctx, sess))
+	d.Handle(event.EventUserSendMessage, handleEventUserSendMessage(ctx, sess, c))
+	d.Handle(event.EventUserReceiveMessage, handleEventUserReceiveMessage(ctx, sess, c))
+	d.Handle(event.EventUserLogout, handleEventUserLogout(ctx, sess))
+	d.Handle(event.EventUserCreateRoom, handleEventUserRoom(ctx, c, sess.CreateRoom))
+	d.Handle(event.EventUserJoinRoom, handleEventUserRoom(ctx, c, sess.JoinRoom))
+	d.Handle(event.EventUserLeaveRoom, handleEventUserRoom(ctx, c, sess.LeaveRoom))
+	d.Handle(event.EventUserListRoomMembers, handleEventUserListRoomMembers(ctx, sess, c))
+	d.Handle(event.EventUserSendRoomMessage, handleEventUserSendRoomMessage(ctx, sess, c))
+	d.Handle(event.EventUserGetHistory, handleEventUserGetHistory(ctx, sess, c))
+	d.Handle(event.EventUserSetPresence, handleEventUserSetPresence(ctx, sess, c))
+	d.Handle(event.EventUserWatchPresence, handleEventUserWatchPresence(ctx, sess, c))
+	d.Handle(event.EventUserUnwatchPresence, handleEventUserUnwatchPresence(ctx, sess, c))
+	d.Handle(event.EventUserReceivePresence, handleEventUserReceivePresence(c))
+	d.Handle(event.EventUserReadMessage, handleEventUserReadMessage(ctx, sess, c))
+	d.Handle(event.EventUserReceiveReceipt, handleEventUserReceiveReceipt(c))
+	d.Handle(event.EventUserTyping, handleEventUserTyping(ctx, sess, c))
+	d.Handle(event.EventUserReceiveTyping, handleEventUserReceiveTyping(c))
+	d.Handle(event.EventUserReceiveReconnect, handleEventUserReceiveReconnect(sess, c))
 
 	err = d.Listen()
 	if err != nil {
@@ -118,6 +699,10 @@ window.addEventListener("load", function(evt) {
 	var output = document.getElementById("output");
 	var input = document.getElementById("input");
 	var receiver = document.getElementById("receiver");
+	var nickname = document.getElementById("nickname");
+	var password = document.getElementById("password");
+	var token = document.getElementById("token");
+	var typing = document.getElementById("typing");
 	var ws;
 	var print = function(message) {
 		var d = document.createElement("div");
@@ -137,12 +722,121 @@ window.addEventListener("load", function(evt) {
 		console.log("SEND:", data);
 	};
 
+	var getHistory = function(peer) {
+		var data = {
+			"action": "get_history",
+			"data": {
+				"peer": peer,
+			}
+		}
+		ws.send(JSON.stringify(data));
+		console.log("SEND:", data);
+	};
+
+	// last sequence number received from each session of each sender, to detect
+	// lost messages
+	var lastSeqs = {};
+	var checkSeq = function(m) {
+		var key = m.from + "\u0000" + m.stream;
+		var last = lastSeqs[key];
+		if (last !== undefined && m.seq > last + 1) {
+			print("[WARNING] " + (m.seq - last - 1) + " message(s) from " + m.from + " lost");
+		}
+		if (last !== undefined && m.seq < last) {
+			print("[WARNING] late message from " + m.from);
+			return;
+		}
+		lastSeqs[key] = m.seq;
+	};
+
+	// messages received while the page was not focused
+	var unread = [];
+	var sendReadReceipts = function() {
+		if (!ws) {
+			return;
+		}
+		unread.forEach(function(m) {
+			var data = {
+				"action": "read_message",
+				"data": {
+					"id": m.id,
+					"from": m.from,
+				}
+			}
+			ws.send(JSON.stringify(data));
+			console.log("SEND:", data);
+		});
+		unread = [];
+	};
+	window.addEventListener("focus", sendReadReceipts);
+
+	// typing indicator: "started" is sent again regularly while the user types,
+	// so the server does not expire it
+	var typingSince = 0;
+	var sendTyping = function(state) {
+		if (!ws || !receiver.value) {
+			return;
+		}
+		var data = {
+			"action": "typing",
+			"data": {
+				"to": receiver.value,
+				"state": state,
+			}
+		}
+		ws.send(JSON.stringify(data));
+	};
+	input.oninput = function(evt) {
+		var now = Date.now();
+		if (now - typingSince > 3000) {
+			typingSince = now;
+			sendTyping("started");
+		}
+	};
+	input.onblur = function(evt) {
+		if (typingSince) {
+			typingSince = 0;
+			sendTyping("stopped");
+		}
+	};
+
+	var watchPresence = function(nicknames) {
+		var data = {
+			"action": "watch_presence",
+			"data": {
+				"nicknames": nicknames,
+			}
+		}
+		ws.send(JSON.stringify(data));
+		console.log("SEND:", data);
+	};
+
+	// load the recent history and watch the presence of the receiver
+	// when a conversation is opened
+	receiver.onchange = function(evt) {
+		if (!ws || !receiver.value) {
+			return;
+		}
+		getHistory(receiver.value);
+		watchPresence([receiver.value]);
+	};
+
 	document.getElementById("open").onclick = function(evt) {
 		if (ws) {
 			return false;
 		}
 		ws = new WebSocket("{{.}}");
 		ws.onopen = function(evt) {
+			// the credentials are sent in the first frame, not in the URL
+			var data = {
+				"action": "login",
+				"data": {
+					"nickname": nickname.value,
+					"password": password.value,
+					"token": token.value,
+				}
+			}
+			ws.send(JSON.stringify(data));
 			print("Connection established.");
 		}
 		ws.onclose = function(evt) {
@@ -152,7 +846,67 @@ window.addEventListener("load", function(evt) {
 		ws.onmessage = function(evt) {
 			console.log("RESPONSE:", evt.data);
 			var msg = JSON.parse(evt.data);
+			if (msg.action == "error") {
+				print("ERROR: " + msg.data.message);
+				return;
+			}
+			if (msg.action == "history") {
+				print("--- history with " + msg.data.peer + " ---");
+				msg.data.messages.forEach(function(m) {
+					print("[" + m.time + "][FROM " + m.from + "] " + m.message);
+				});
+				print("---");
+				return;
+			}
+			if (msg.action == "reconnect") {
+				// keep the same nickname on the next server
+				print("Server is shutting down, reconnect in " + msg.data.delay + "ms.");
+				nickname.value = msg.data.nickname;
+				ws.close();
+				setTimeout(function() {
+					document.getElementById("open").click();
+				}, msg.data.delay);
+				return;
+			}
+			if (msg.action == "typing") {
+				typing.innerHTML = msg.data.state == "started" ? msg.data.from + " is typing..." : "";
+				return;
+			}
+			if (msg.action == "message_sent") {
+				console.log("message " + msg.data.id + " sent to " + msg.data.to);
+				return;
+			}
+			if (msg.action == "receipt") {
+				print("[RECEIPT] message " + msg.data.id + " " + msg.data.status + " by " + msg.data.by);
+				return;
+			}
+			if (msg.action == "presence") {
+				print("[PRESENCE] " + msg.data.nickname + " is " + msg.data.status);
+				return;
+			}
+			if (msg.action == "room_members") {
+				print("[ROOM " + msg.data.room + "] members: " + msg.data.members.join(", "));
+				return;
+			}
+			if (msg.action == "receive_room_message") {
+				print("[ROOM " + msg.data.room + "][FROM " + msg.data.from + "] " + msg.data.message);
+				return;
+			}
+			if (msg.data.echo) {
+				// sent from another device
+				print("[TO " + msg.data.to + "] " + msg.data.message);
+				return;
+			}
+			if (msg.data.seq) {
+				checkSeq(msg.data);
+			}
 			print("[FROM "+ msg.data.from + "] " + msg.data.message);
+			if (msg.data.id && msg.data.from != "SYSTEM") {
+				unread.push(msg.data);
+				if (document.hasFocus()) {
+					sendReadReceipts();
+				}
+			}
 		}
 		ws.onerror = function(evt) {
 			print("ERROR: " + evt.data);
@@ -166,6 +920,8 @@ window.addEventListener("load", function(evt) {
 		}
 		print("[TO " + receiver.value + "] " + input.value)
 		sendMessage(receiver.value, input.value);
+		typingSince = 0;
+		sendTyping("stopped");
 		return false;
 	};
 	
@@ -191,6 +947,9 @@ window.addEventListener("load", function(evt) {
 			<p>
 				<form>
 					<p>
+						<input id="nickname" type="text" placeholder="nickname (optional)">
+						<input id="password" type="password" placeholder="password (optional)">
+						<input id="token" type="text" placeholder="token (optional)">
 						<button id="open">Open</button>
 						<button id="close">Close</button>
 					</p>
@@ -204,6 +963,7 @@ window.addEventListener("load", function(evt) {
 		</td>
 		<td valign="top" width="50%">
 			<div id="output"></div>
+			<div id="typing"></div>
 		</td>
 	</tr>
 </table>
@@ -5,20 +5,41 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	dbpkg "github.com/nouney/fluxracine/internal/db"
+	"github.com/nouney/fluxracine/internal/db/cache"
+	"github.com/nouney/fluxracine/internal/db/file"
+	"github.com/nouney/fluxracine/internal/db/memory"
 	"github.com/nouney/fluxracine/internal/db/redis"
 	"github.com/nouney/fluxracine/pkg/chat"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/websocket"
 )
 
+// overflowPolicies are the values of OUTBOX_POLICY
+var overflowPolicies = map[string]chat.OverflowPolicy{
+	"":            chat.DropOldest,
+	"drop_oldest": chat.DropOldest,
+	"drop_newest": chat.DropNewest,
+	"disconnect":  chat.Disconnect,
+}
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 var (
 	upgrader websocket.Upgrader
 	server   *chat.Server
 	port     string
+	// requestTimeout bounds the handling of each action of the users
+	requestTimeout = 10 * time.Second
+	// closed once the chat server has been shut down
+	shutdown = make(chan struct{})
 )
 
 func init() {
@@ -29,7 +50,7 @@ func init() {
 		port = "8000"
 	}
 
-	opts := []chat.Opt{}
+	opts := []chat.Opt{chat.WithVersion(version)}
 	clusterHTTPListenPort := os.Getenv("CLUSTER_HTTP_LISTEN_PORT")
 	if clusterHTTPListenPort == "" {
 		clusterHTTPListenPort = "3000"
@@ -37,16 +58,226 @@ func init() {
 	podIP := os.Getenv("POD_IP")
 	opts = append(opts, chat.WithHTTPAddress(podIP+":"+clusterHTTPListenPort))
 
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		panic("REDIS_ADDR is missing")
+	// DB_BACKEND selects the storage: "redis", "memory" or "file". By default, it
+	// is redis if REDIS_URL or REDIS_ADDR is set, memory otherwise. Without redis,
+	// the server runs standalone: there is no cluster
+	var (
+		db       *redis.Redis
+		store    dbpkg.DB
+		history  dbpkg.History
+		presence dbpkg.Presence
+		inbox    dbpkg.Inbox
+		err      error
+	)
+	backend := os.Getenv("DB_BACKEND")
+	if backend == "" {
+		backend = "memory"
+		if os.Getenv("REDIS_URL") != "" || os.Getenv("REDIS_ADDR") != "" {
+			backend = "redis"
+		}
 	}
-	db, err := redis.New(redisAddr, "")
-	if err != nil {
-		panic(err)
+	switch backend {
+	case "redis":
+		// REDIS_URL gives the whole connection spec, e.g. sentinel, cluster or TLS,
+		// see redis.ParseURL. Otherwise, REDIS_ADDR is a single server
+		var cfg *redis.Config
+		if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+			cfg, err = redis.ParseURL(redisURL)
+			if err != nil {
+				panic(err)
+			}
+		} else {
+			redisAddr := os.Getenv("REDIS_ADDR")
+			if redisAddr == "" {
+				panic("REDIS_URL or REDIS_ADDR is missing")
+			}
+			cfg = &redis.Config{Addrs: []string{redisAddr}, Password: os.Getenv("REDIS_PASSWORD")}
+		}
+		// REDIS_PREFIX namespaces the keys, "webchat:" by default, e.g. to share a
+		// redis between environments. The keys are moved under a new prefix by
+		// webchat-migrate, also from the versions which had no prefix
+		if prefix := os.Getenv("REDIS_PREFIX"); prefix != "" {
+			cfg.Prefix = prefix
+		}
+		db, err = redis.NewFromConfig(cfg)
+		if err != nil {
+			panic(err)
+		}
+		store, history, presence, inbox = db, db, db, db
+	case "memory":
+		log.Warn("no redis, run standalone with an in-memory storage")
+		store, history, presence, inbox = memory.NewDB(), memory.NewHistory(), memory.NewPresence(), memory.NewInbox()
+	case "file":
+		path := os.Getenv("DB_FILE")
+		if path == "" {
+			path = "webchat.db"
+		}
+		f, err := file.Open(path)
+		if err != nil {
+			panic(err)
+		}
+		log.Infof("no redis, run standalone with the storage in \"%s\"", path)
+		store, history, presence, inbox = f, f, f, f
+	default:
+		panic("unknown DB_BACKEND: " + backend)
+	}
+
+	opts = append(opts, chat.WithHistory(history), chat.WithPresence(presence))
+
+	switch transport := os.Getenv("CLUSTER_TRANSPORT"); transport {
+	case "", "http":
+	case "redis":
+		if db == nil {
+			panic("CLUSTER_TRANSPORT redis requires the redis backend")
+		}
+		opts = append(opts, chat.WithPubSubTransport(db))
+	case "stream":
+		opts = append(opts, chat.WithStreamTransport(2, 2*time.Millisecond, 128))
+	default:
+		panic("unknown CLUSTER_TRANSPORT: " + transport)
+	}
+
+	forwardPolicy := chat.DefaultForwardPolicy
+	if timeout := os.Getenv("FORWARD_TIMEOUT"); timeout != "" {
+		forwardPolicy.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if retries := os.Getenv("FORWARD_RETRIES"); retries != "" {
+		forwardPolicy.Retries, err = strconv.Atoi(retries)
+		if err != nil {
+			panic(err)
+		}
+	}
+	opts = append(opts, chat.WithForwardPolicy(forwardPolicy))
+
+	if certFile := os.Getenv("CLUSTER_TLS_CERT"); certFile != "" {
+		cfg, err := chat.NewClusterTLSConfig(certFile, os.Getenv("CLUSTER_TLS_KEY"), os.Getenv("CLUSTER_TLS_CA"))
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, chat.WithClusterTLS(cfg))
+	}
+	if secret := os.Getenv("CLUSTER_SECRET"); secret != "" {
+		opts = append(opts, chat.WithClusterSecret([]byte(secret), 30*time.Second))
+	}
+
+	// the offline inbox is disabled unless a ttl is given
+	if inboxTTL := os.Getenv("OFFLINE_INBOX_TTL"); inboxTTL != "" {
+		ttl, err := time.ParseDuration(inboxTTL)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, chat.WithOfflineInbox(inbox, ttl))
+	}
+
+	if capacity := os.Getenv("OUTBOX_CAPACITY"); capacity != "" {
+		n, err := strconv.Atoi(capacity)
+		if err != nil {
+			panic(err)
+		}
+		policy, ok := overflowPolicies[os.Getenv("OUTBOX_POLICY")]
+		if !ok {
+			panic("unknown OUTBOX_POLICY: " + os.Getenv("OUTBOX_POLICY"))
+		}
+		opts = append(opts, chat.WithOutbox(n, policy))
 	}
 
-	server, err = chat.NewServer(db, opts...)
+	switch authMode := os.Getenv("AUTH_MODE"); authMode {
+	case "":
+	case "token":
+		auth, err := chat.NewTokenAuthenticator([]byte(os.Getenv("AUTH_TOKEN_SECRET")))
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, chat.WithAuthenticator(auth))
+	case "static":
+		auth, err := chat.NewStaticAuthenticator(os.Getenv("AUTH_USERS_FILE"))
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, chat.WithAuthenticator(auth))
+	default:
+		panic("unknown AUTH_MODE: " + authMode)
+	}
+
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		opts = append(opts, chat.WithAdmin(token))
+	}
+
+	// clients are asked to reconnect after DRAIN_DELAY on shutdown, and are
+	// disconnected after DRAIN_TIMEOUT
+	drainDelay, drainTimeout := time.Second, 20*time.Second
+	if delay := os.Getenv("DRAIN_DELAY"); delay != "" {
+		drainDelay, err = time.ParseDuration(delay)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if timeout := os.Getenv("DRAIN_TIMEOUT"); timeout != "" {
+		drainTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// the calls to the db which are not bound to an action of a user get the same timeout
+	if timeout := os.Getenv("REQUEST_TIMEOUT"); timeout != "" {
+		requestTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			panic(err)
+		}
+	}
+	opts = append(opts, chat.WithDBTimeout(requestTimeout))
+
+	// the sessions of the users are cached with redis, unless ROUTE_CACHE_SIZE is 0:
+	// the memory and file storages are local, there is nothing to cache
+	routes := store
+	cacheSize, cacheTTL := 10000, 10*time.Second
+	if size := os.Getenv("ROUTE_CACHE_SIZE"); size != "" {
+		cacheSize, err = strconv.Atoi(size)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if ttl := os.Getenv("ROUTE_CACHE_TTL"); ttl != "" {
+		cacheTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if cacheSize > 0 && db != nil {
+		c, err := cache.New(db, cacheSize, cacheTTL, db)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			err := c.Listen()
+			if err != nil {
+				log.Error(errors.Wrap(err, "route cache"))
+			}
+		}()
+		routes = c
+	}
+
+	if db != nil {
+		heartbeatTTL := 15 * time.Second
+		if ttl := os.Getenv("NODE_HEARTBEAT_TTL"); ttl != "" {
+			heartbeatTTL, err = time.ParseDuration(ttl)
+			if err != nil {
+				panic(err)
+			}
+		}
+		// the sessions purged from the registry are invalidated in the caches
+		var registry dbpkg.Registry = db
+		if c, ok := routes.(*cache.DB); ok {
+			registry = c.Registry(db)
+		}
+		opts = append(opts, chat.WithNodeRegistry(registry, heartbeatTTL))
+	}
+
+	server, err = chat.NewServer(routes, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -57,7 +288,9 @@ func init() {
 	)
 	go func() {
 		<-sigc
+		server.Drain(drainDelay, drainTimeout)
 		server.GracefulShutdown()
+		close(shutdown)
 	}()
 	server.Run()
 }
@@ -66,6 +299,15 @@ func main() {
 	http.HandleFunc("/", handleHome)
 	http.HandleFunc("/chat", handleChatSession)
 
+	srv := &http.Server{Addr: ":" + port}
+	go func() {
+		<-shutdown
+		srv.Close()
+	}()
 	log.Infof("listening on :%s", port)
-	http.ListenAndServe(":"+port, nil)
+	err := srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	log.Info("server shut down")
 }
@@ -0,0 +1,306 @@
+// Package cache provides a read-through cache in front of a db.DB.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// InvalidationChannel is the channel on which the caches of all the servers
+// are told that the sessions of a user changed. The message is the nickname of the
+// user, or "@" followed by the address of a server whose sessions were all removed.
+const InvalidationChannel = "invalidate:sessions"
+
+const (
+	// delays before subscribing again to InvalidationChannel after an error,
+	// doubled after each failure
+	resubscribeMinBackoff = 100 * time.Millisecond
+	resubscribeMaxBackoff = 10 * time.Second
+)
+
+// DB caches the sessions of the users retrieved from another db.DB.
+// The cache is bounded in size and its entries expire after a TTL. An entry is
+// invalidated when the sessions of the user are changed through any DB of the cluster
+// sharing the same PubSub, or when InvalidateSessions is called.
+// Other methods are passed through.
+// Thread-safe.
+type DB struct {
+	db.DB
+	size int
+	ttl  time.Duration
+	ps   db.PubSub
+
+	mutex sync.Mutex
+	// entries by nickname, and their list from the most to the least recently used
+	entries map[string]*list.Element
+	lru     *list.List
+	// incremented by each invalidation, so that a concurrent lookup does not cache stale sessions
+	generation uint64
+	sub        db.Subscription
+	// closed by Close, stops Listen
+	done   chan struct{}
+	closed bool
+}
+
+// entry is the cached sessions of a user.
+type entry struct {
+	nickname  string
+	endpoints []db.Endpoint
+	expiry    time.Time
+}
+
+// New creates a new DB object caching the sessions of at most size users from backend, for ttl.
+// ps is used to propagate the invalidations to the other servers, it can be nil if
+// there is a single server.
+func New(backend db.DB, size int, ttl time.Duration, ps db.PubSub) (*DB, error) {
+	if size <= 0 || ttl <= 0 {
+		return nil, errors.New("cache: size and ttl must be positive")
+	}
+	return &DB{
+		DB:      backend,
+		size:    size,
+		ttl:     ttl,
+		ps:      ps,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// GetSessions retrieves the sessions of a user, from the cache if possible.
+func (c *DB) GetSessions(ctx context.Context, nickname string) ([]db.Endpoint, error) {
+	c.mutex.Lock()
+	if el, ok := c.entries[nickname]; ok {
+		e := el.Value.(*entry)
+		if time.Now().Before(e.expiry) {
+			c.lru.MoveToFront(el)
+			// the caller may modify the returned sessions
+			endpoints := append([]db.Endpoint(nil), e.endpoints...)
+			c.mutex.Unlock()
+			return endpoints, nil
+		}
+		c.remove(el)
+	}
+	generation := c.generation
+	c.mutex.Unlock()
+
+	endpoints, err := c.DB.GetSessions(ctx, nickname)
+	if err != nil {
+		return nil, err
+	}
+	c.add(nickname, endpoints, generation)
+	return endpoints, nil
+}
+
+// AddSession registers a session of a user and invalidates the cached ones.
+func (c *DB) AddSession(ctx context.Context, nickname string, e db.Endpoint, exclusive bool) error {
+	err := c.DB.AddSession(ctx, nickname, e, exclusive)
+	if err == nil {
+		c.invalidate(ctx, nickname)
+	}
+	return err
+}
+
+// RemoveSession un-registers a session of a user and invalidates the cached ones.
+func (c *DB) RemoveSession(ctx context.Context, nickname string, e db.Endpoint) error {
+	err := c.DB.RemoveSession(ctx, nickname, e)
+	c.invalidate(ctx, nickname)
+	return err
+}
+
+// InvalidateSessions drops the cached sessions of a user on this server only,
+// e.g. because they do not exist anymore.
+func (c *DB) InvalidateSessions(nickname string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	if el, ok := c.entries[nickname]; ok {
+		c.remove(el)
+	}
+}
+
+// Listen receives the invalidations sent by the other servers.
+// It blocks until Close is called. After an error, it subscribes again and flushes
+// the cache, since invalidations may have been missed meanwhile.
+func (c *DB) Listen() error {
+	if c.ps == nil {
+		return errors.New("cache: no pubsub")
+	}
+	backoff := resubscribeMinBackoff
+	for {
+		sub, err := c.subscribe()
+		if err == nil && sub == nil {
+			// closed
+			return nil
+		}
+		if err == nil {
+			err = c.receive(sub)
+			if err == nil {
+				return nil
+			}
+			sub.Close()
+			backoff = resubscribeMinBackoff
+		}
+		c.flush()
+		log.Error(errors.Wrapf(err, "cache: subscribe again in %s", backoff))
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > resubscribeMaxBackoff {
+			backoff = resubscribeMaxBackoff
+		}
+	}
+}
+
+// subscribe subscribes to InvalidationChannel. It returns a nil subscription if the
+// cache has been closed.
+func (c *DB) subscribe() (db.Subscription, error) {
+	sub, err := c.ps.Subscribe(context.Background(), InvalidationChannel)
+	if err != nil {
+		return nil, errors.Wrap(err, "subscribe")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil, sub.Close()
+	}
+	c.sub = sub
+	return sub, nil
+}
+
+// receive applies the invalidations received by a subscription until it is closed.
+func (c *DB) receive(sub db.Subscription) error {
+	for {
+		b, err := sub.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "receive")
+		}
+		msg := string(b)
+		if strings.HasPrefix(msg, "@") {
+			c.invalidateServer(strings.TrimPrefix(msg, "@"))
+		} else {
+			c.InvalidateSessions(msg)
+		}
+	}
+}
+
+// Close stops receiving the invalidations.
+func (c *DB) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.sub == nil {
+		return nil
+	}
+	return c.sub.Close()
+}
+
+// Registry returns r, whose PurgeNode also invalidates on all the servers the
+// cached sessions connected on the purged server.
+func (c *DB) Registry(r db.Registry) db.Registry {
+	return &registry{Registry: r, cache: c}
+}
+
+// registry invalidates the cache of the sessions of the servers it purges.
+type registry struct {
+	db.Registry
+	cache *DB
+}
+
+// PurgeNode un-registers a server and removes the sessions connected on it.
+func (r *registry) PurgeNode(ctx context.Context, server string) ([]string, error) {
+	nicknames, err := r.Registry.PurgeNode(ctx, server)
+	// the sessions may have been partially removed
+	r.cache.invalidateServer(server)
+	if r.cache.ps != nil {
+		r.cache.ps.Publish(ctx, InvalidationChannel, []byte("@"+server))
+	}
+	return nicknames, err
+}
+
+// invalidateServer drops the cached sessions of the users connected on a server,
+// on this server only.
+func (c *DB) invalidateServer(server string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		for _, e := range el.Value.(*entry).endpoints {
+			if e.Server == server {
+				c.remove(el)
+				break
+			}
+		}
+		el = next
+	}
+}
+
+// invalidate drops the cached sessions of a user on all the servers.
+func (c *DB) invalidate(ctx context.Context, nickname string) {
+	c.InvalidateSessions(nickname)
+	if c.ps != nil {
+		// the other servers keep their entry until it expires if this fails
+		c.ps.Publish(ctx, InvalidationChannel, []byte(nickname))
+	}
+}
+
+// add caches the sessions of a user, evicting the least recently used entry if the cache is full.
+// Nothing is cached if an invalidation happened since generation.
+func (c *DB) add(nickname string, endpoints []db.Endpoint, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.generation != generation {
+		return
+	}
+	if el, ok := c.entries[nickname]; ok {
+		c.remove(el)
+	}
+	c.entries[nickname] = c.lru.PushFront(&entry{
+		nickname:  nickname,
+		endpoints: append([]db.Endpoint(nil), endpoints...),
+		expiry:    time.Now().Add(c.ttl),
+	})
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes an entry from the cache. The caller must hold the lock.
+func (c *DB) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*entry).nickname)
+}
+
+// flush empties the cache.
+func (c *DB) flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
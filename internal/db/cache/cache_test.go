@@ -0,0 +1,437 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/nouney/fluxracine/internal/db/memory"
+	"github.com/pkg/errors"
+)
+
+const testTimeout = 2 * time.Second
+
+// backend counts the lookups of the sessions reaching the memory DB.
+type backend struct {
+	*memory.DB
+	gets int32
+	// called by GetSessions before returning, if not nil
+	onGet func()
+}
+
+func (b *backend) GetSessions(ctx context.Context, nickname string) ([]db.Endpoint, error) {
+	atomic.AddInt32(&b.gets, 1)
+	endpoints, err := b.DB.GetSessions(ctx, nickname)
+	if b.onGet != nil {
+		b.onGet()
+	}
+	return endpoints, err
+}
+
+// pubsub is an in-memory db.PubSub.
+type pubsub struct {
+	mutex sync.Mutex
+	subs  map[string][]*subscription
+}
+
+func newPubSub() *pubsub {
+	return &pubsub{subs: make(map[string][]*subscription)}
+}
+
+func (ps *pubsub) Publish(ctx context.Context, channel string, msg []byte) (int, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	n := 0
+	for _, sub := range ps.subs[channel] {
+		select {
+		case <-sub.done:
+		case sub.msgs <- msg:
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (ps *pubsub) Subscribe(ctx context.Context, channel string) (db.Subscription, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	sub := &subscription{
+		msgs: make(chan []byte, 16),
+		errs: make(chan error, 1),
+		done: make(chan struct{}),
+	}
+	ps.subs[channel] = append(ps.subs[channel], sub)
+	return sub, nil
+}
+
+// subscriptions returns the subscriptions made to a channel, open or not.
+func (ps *pubsub) subscriptions(channel string) []*subscription {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return append([]*subscription(nil), ps.subs[channel]...)
+}
+
+type subscription struct {
+	msgs chan []byte
+	// errors returned by Next, to simulate a lost connection
+	errs chan error
+	done chan struct{}
+	once sync.Once
+}
+
+func (s *subscription) Next() ([]byte, error) {
+	select {
+	case <-s.done:
+		return nil, io.EOF
+	case err := <-s.errs:
+		return nil, err
+	case msg := <-s.msgs:
+		return msg, nil
+	}
+}
+
+func (s *subscription) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+// memoryRegistry purges the sessions of the servers from a memory DB.
+type memoryRegistry struct {
+	db.Registry
+	backend *memory.DB
+}
+
+func (r *memoryRegistry) PurgeNode(ctx context.Context, server string) ([]string, error) {
+	var nicknames []string
+	for _, nickname := range []string{"alice", "bob", "carol"} {
+		endpoints, err := r.backend.GetSessions(ctx, nickname)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range endpoints {
+			if e.Server == server {
+				r.backend.RemoveSession(ctx, nickname, e)
+			}
+		}
+		if _, err := r.backend.GetSessions(ctx, nickname); errors.Cause(err) == db.ErrNotFound {
+			nicknames = append(nicknames, nickname)
+		}
+	}
+	return nicknames, nil
+}
+
+var (
+	laptop = db.Endpoint{Server: "10.0.0.1:8080", Session: "laptop"}
+	phone  = db.Endpoint{Server: "10.0.0.2:8080", Session: "phone"}
+)
+
+// newTestCache returns a cache in front of a memory DB in which alice is connected
+// on laptop, bob on phone and carol on both.
+func newTestCache(t *testing.T, size int, ttl time.Duration, ps db.PubSub) (*DB, *backend) {
+	t.Helper()
+	ctx := context.Background()
+	b := &backend{DB: memory.NewDB()}
+	for _, s := range []struct {
+		nickname string
+		e        db.Endpoint
+	}{
+		{"alice", laptop},
+		{"bob", phone},
+		{"carol", laptop},
+		{"carol", phone},
+	} {
+		if err := b.AddSession(ctx, s.nickname, s.e, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := New(b, size, ttl, ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, b
+}
+
+// cached reports whether the sessions of a user are cached.
+func cached(c *DB, nickname string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.entries[nickname]
+	return ok
+}
+
+// lookup retrieves the sessions of users and returns the number of lookups that
+// reached the backend.
+func lookup(t *testing.T, c *DB, b *backend, nicknames ...string) int32 {
+	t.Helper()
+	before := atomic.LoadInt32(&b.gets)
+	for _, nickname := range nicknames {
+		if _, err := c.GetSessions(context.Background(), nickname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return atomic.LoadInt32(&b.gets) - before
+}
+
+// eventually waits until cond is true.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// listen runs c.Listen and returns a function closing c and waiting for Listen to return.
+func listen(t *testing.T, c *DB) func() {
+	done := make(chan error)
+	go func() {
+		done <- c.Listen()
+	}()
+	return func() {
+		c.Close()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(testTimeout):
+			t.Error("Listen did not return")
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, test := range []struct {
+		size int
+		ttl  time.Duration
+	}{
+		{0, time.Minute},
+		{10, 0},
+	} {
+		if _, err := New(memory.NewDB(), test.size, test.ttl, nil); err == nil {
+			t.Errorf("size %d, ttl %s accepted", test.size, test.ttl)
+		}
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c, b := newTestCache(t, 2, time.Minute, nil)
+	if n := lookup(t, c, b, "alice", "bob", "alice", "bob"); n != 2 {
+		t.Errorf("expected 2 lookups, got %d", n)
+	}
+	// alice is used more recently than bob, who is evicted by carol
+	if n := lookup(t, c, b, "alice", "carol"); n != 1 {
+		t.Errorf("expected 1 lookup, got %d", n)
+	}
+	if cached(c, "bob") || !cached(c, "alice") || !cached(c, "carol") {
+		t.Error("least recently used entry not evicted")
+	}
+	if n := lookup(t, c, b, "bob"); n != 1 {
+		t.Errorf("expected 1 lookup of the evicted entry, got %d", n)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	ttl := 50 * time.Millisecond
+	c, b := newTestCache(t, 10, ttl, nil)
+	if n := lookup(t, c, b, "alice", "alice"); n != 1 {
+		t.Errorf("expected 1 lookup, got %d", n)
+	}
+	time.Sleep(2 * ttl)
+	if n := lookup(t, c, b, "alice"); n != 1 {
+		t.Errorf("expected 1 lookup of the expired entry, got %d", n)
+	}
+}
+
+func TestGetSessionsCopy(t *testing.T) {
+	c, _ := newTestCache(t, 10, time.Minute, nil)
+	for i := 0; i < 2; i++ {
+		endpoints, err := c.GetSessions(context.Background(), "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(endpoints) != 1 || endpoints[0] != laptop {
+			t.Fatalf("unexpected sessions %v", endpoints)
+		}
+		endpoints[0] = phone
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	ctx := context.Background()
+	c, b := newTestCache(t, 10, time.Minute, nil)
+	lookup(t, c, b, "alice", "bob")
+
+	if err := c.AddSession(ctx, "alice", phone, false); err != nil {
+		t.Fatal(err)
+	}
+	if cached(c, "alice") || !cached(c, "bob") {
+		t.Error("AddSession: unexpected invalidation")
+	}
+	lookup(t, c, b, "alice")
+	if err := c.RemoveSession(ctx, "alice", phone); err != nil {
+		t.Fatal(err)
+	}
+	if cached(c, "alice") {
+		t.Error("RemoveSession: sessions not invalidated")
+	}
+	lookup(t, c, b, "alice")
+	c.InvalidateSessions("alice")
+	if cached(c, "alice") {
+		t.Error("InvalidateSessions: sessions not invalidated")
+	}
+	endpoints, err := c.GetSessions(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0] != laptop {
+		t.Errorf("unexpected sessions %v", endpoints)
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	c, b := newTestCache(t, 10, time.Minute, nil)
+	// the sessions change while they are looked up
+	b.onGet = func() {
+		b.onGet = nil
+		c.InvalidateSessions("alice")
+	}
+	lookup(t, c, b, "alice")
+	if cached(c, "alice") {
+		t.Error("stale sessions cached")
+	}
+	lookup(t, c, b, "alice")
+	if !cached(c, "alice") {
+		t.Error("sessions not cached")
+	}
+}
+
+func TestListen(t *testing.T) {
+	ctx := context.Background()
+	ps := newPubSub()
+	c1, b := newTestCache(t, 10, time.Minute, ps)
+	// another server using the same backend
+	c2, err := New(b, 10, time.Minute, ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*DB{c1, c2} {
+		defer listen(t, c)()
+	}
+	eventually(t, "the subscriptions", func() bool {
+		return len(ps.subscriptions(InvalidationChannel)) == 2
+	})
+
+	lookup(t, c2, b, "alice", "bob", "carol")
+	if err := c1.AddSession(ctx, "alice", phone, false); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the invalidation of alice", func() bool {
+		return !cached(c2, "alice")
+	})
+	if !cached(c2, "bob") || !cached(c2, "carol") {
+		t.Error("unexpected invalidation")
+	}
+
+	// the sessions of the users connected on a server
+	lookup(t, c2, b, "alice")
+	ps.Publish(ctx, InvalidationChannel, []byte("@"+laptop.Server))
+	eventually(t, "the invalidation of the server", func() bool {
+		return !cached(c2, "alice") && !cached(c2, "carol")
+	})
+	if !cached(c2, "bob") {
+		t.Error("sessions on another server invalidated")
+	}
+}
+
+func TestListenResubscribe(t *testing.T) {
+	ctx := context.Background()
+	ps := newPubSub()
+	c, b := newTestCache(t, 10, time.Minute, ps)
+	defer listen(t, c)()
+	eventually(t, "the subscription", func() bool {
+		return len(ps.subscriptions(InvalidationChannel)) == 1
+	})
+
+	lookup(t, c, b, "alice", "bob")
+	ps.subscriptions(InvalidationChannel)[0].errs <- errors.New("connection lost")
+	// the invalidations sent meanwhile may have been missed
+	eventually(t, "the flush", func() bool {
+		return !cached(c, "alice") && !cached(c, "bob")
+	})
+	eventually(t, "the new subscription", func() bool {
+		return len(ps.subscriptions(InvalidationChannel)) == 2
+	})
+	select {
+	case <-ps.subscriptions(InvalidationChannel)[0].done:
+	default:
+		t.Error("failed subscription not closed")
+	}
+
+	lookup(t, c, b, "alice")
+	ps.Publish(ctx, InvalidationChannel, []byte("alice"))
+	eventually(t, "the invalidation after subscribing again", func() bool {
+		return !cached(c, "alice")
+	})
+}
+
+func TestListenClose(t *testing.T) {
+	c, _ := newTestCache(t, 10, time.Minute, nil)
+	if err := c.Listen(); err == nil {
+		t.Error("Listen without pubsub")
+	}
+
+	ps := newPubSub()
+	c, _ = newTestCache(t, 10, time.Minute, ps)
+	listen(t, c)()
+	// closed before subscribing
+	if err := c.Listen(); err != nil {
+		t.Error(err)
+	}
+	for _, sub := range ps.subscriptions(InvalidationChannel) {
+		select {
+		case <-sub.done:
+		default:
+			t.Error("subscription not closed")
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	ps := newPubSub()
+	c, b := newTestCache(t, 10, time.Minute, ps)
+	sub, err := ps.Subscribe(ctx, InvalidationChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := c.Registry(&memoryRegistry{backend: b.DB})
+
+	lookup(t, c, b, "alice", "bob", "carol")
+	nicknames, err := r.PurgeNode(ctx, laptop.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nicknames) != 1 || nicknames[0] != "alice" {
+		t.Errorf("unexpected nicknames %v", nicknames)
+	}
+	if cached(c, "alice") || cached(c, "carol") || !cached(c, "bob") {
+		t.Error("sessions of the purged server not invalidated")
+	}
+	msg, err := sub.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "@"+laptop.Server {
+		t.Errorf("unexpected invalidation \"%s\"", msg)
+	}
+}
@@ -1,17 +1,64 @@
 package db
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
-// DB is the database used by the chat servers
+// DB is the database used by the chat servers.
+// All the methods give up with ctx.Err() once ctx is done.
 type DB interface {
-	// AssignServer assigns a server to a user
-	AssignServer(nickname, server string) error
-	// GetServer retrieves the server associated to the user
-	GetServer(nickname string) (string, error)
-	// UnassignServer un-assigns a server from a user
-	UnassignServer(nickname string) error
+	// AddSession registers a session of a user.
+	// If exclusive is true, the session is registered only if the user has no other
+	// session, otherwise ErrAlreadyExists is returned.
+	AddSession(ctx context.Context, nickname string, e Endpoint, exclusive bool) error
+	// GetSessions retrieves the sessions of a user.
+	// Returns ErrNotFound if the user has no session.
+	GetSessions(ctx context.Context, nickname string) ([]Endpoint, error)
+	// RemoveSession un-registers a session of a user.
+	RemoveSession(ctx context.Context, nickname string, e Endpoint) error
+
+	// CreateRoom creates an empty room.
+	// Returns ErrAlreadyExists if the room exists.
+	CreateRoom(ctx context.Context, room string) error
+	// JoinRoom adds a user to a room.
+	// Returns ErrNotFound if the room does not exist.
+	JoinRoom(ctx context.Context, room, nickname string) error
+	// LeaveRoom removes a user from a room.
+	// Returns ErrNotFound if the room does not exist.
+	LeaveRoom(ctx context.Context, room, nickname string) error
+	// GetRoomMembers retrieves the nicknames of the members of a room.
+	// Returns ErrNotFound if the room does not exist.
+	GetRoomMembers(ctx context.Context, room string) ([]string, error)
+}
+
+// Endpoint identifies a session of a user: the server on which it is connected,
+// and its ID on this server.
+type Endpoint struct {
+	Server  string
+	Session string
+}
+
+// Servers returns the servers of a list of sessions, without duplicates.
+func Servers(endpoints []Endpoint) []string {
+	servers := make([]string, 0, len(endpoints))
+	seen := make(map[string]bool)
+	for _, e := range endpoints {
+		if !seen[e.Server] {
+			seen[e.Server] = true
+			servers = append(servers, e.Server)
+		}
+	}
+	return servers
+}
+
+// Invalidator is implemented by the DBs caching the sessions of the users.
+type Invalidator interface {
+	// InvalidateSessions drops the cached sessions of a user.
+	InvalidateSessions(nickname string)
 }
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
 )
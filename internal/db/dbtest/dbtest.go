@@ -0,0 +1,378 @@
+// Package dbtest provides the conformance tests shared by the db backends.
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/pkg/errors"
+)
+
+// Backend is the implementation of the db interfaces by a backend.
+type Backend struct {
+	DB       db.DB
+	History  db.History
+	Inbox    db.Inbox
+	Presence db.Presence
+}
+
+// Run runs the conformance tests against the backends created by open.
+// open is called once per test, and returns a function releasing the backend.
+func Run(t *testing.T, open func(t *testing.T) (*Backend, func())) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, b *Backend)
+	}{
+		{"Sessions", testSessions},
+		{"Rooms", testRooms},
+		{"History", testHistory},
+		{"Inbox", testInbox},
+		{"InboxExpiry", testInboxExpiry},
+		{"Presence", testPresence},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			b, release := open(t)
+			defer release()
+			test.f(t, b)
+		})
+	}
+}
+
+func testSessions(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	laptop := db.Endpoint{Server: "10.0.0.1:8080", Session: "laptop"}
+	phone := db.Endpoint{Server: "10.0.0.2:8080", Session: "phone"}
+
+	_, err := b.DB.GetSessions(ctx, "alice")
+	if errors.Cause(err) != db.ErrNotFound {
+		t.Errorf("no session: expected ErrNotFound, got %v", err)
+	}
+	err = b.DB.AddSession(ctx, "alice", laptop, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.DB.AddSession(ctx, "alice", phone, true)
+	if errors.Cause(err) != db.ErrAlreadyExists {
+		t.Errorf("exclusive session: expected ErrAlreadyExists, got %v", err)
+	}
+	err = b.DB.AddSession(ctx, "alice", phone, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := b.DB.GetSessions(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := endpoints(sessions); got != "10.0.0.1:8080/laptop,10.0.0.2:8080/phone" {
+		t.Errorf("unexpected sessions %s", got)
+	}
+
+	err = b.DB.RemoveSession(ctx, "alice", laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err = b.DB.GetSessions(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := endpoints(sessions); got != "10.0.0.2:8080/phone" {
+		t.Errorf("unexpected sessions %s", got)
+	}
+	err = b.DB.RemoveSession(ctx, "alice", phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.DB.GetSessions(ctx, "alice")
+	if errors.Cause(err) != db.ErrNotFound {
+		t.Errorf("removed sessions: expected ErrNotFound, got %v", err)
+	}
+	// the nickname is free again
+	err = b.DB.AddSession(ctx, "alice", laptop, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// endpoints formats a list of sessions in a stable order.
+func endpoints(sessions []db.Endpoint) string {
+	s := make([]string, len(sessions))
+	for i, e := range sessions {
+		s[i] = e.Server + "/" + e.Session
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func testRooms(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	for _, err := range []error{
+		b.DB.JoinRoom(ctx, "general", "alice"),
+		b.DB.LeaveRoom(ctx, "general", "alice"),
+	} {
+		if errors.Cause(err) != db.ErrNotFound {
+			t.Errorf("missing room: expected ErrNotFound, got %v", err)
+		}
+	}
+	_, err := b.DB.GetRoomMembers(ctx, "general")
+	if errors.Cause(err) != db.ErrNotFound {
+		t.Errorf("missing room: expected ErrNotFound, got %v", err)
+	}
+
+	err = b.DB.CreateRoom(ctx, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.DB.CreateRoom(ctx, "general")
+	if errors.Cause(err) != db.ErrAlreadyExists {
+		t.Errorf("existing room: expected ErrAlreadyExists, got %v", err)
+	}
+	members, err := b.DB.GetRoomMembers(ctx, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 0 {
+		t.Errorf("new room: unexpected members %v", members)
+	}
+
+	for _, nickname := range []string{"alice", "bob", "alice"} {
+		err = b.DB.JoinRoom(ctx, "general", nickname)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	members, err = b.DB.GetRoomMembers(ctx, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(members)
+	if got := strings.Join(members, ","); got != "alice,bob" {
+		t.Errorf("unexpected members %s", got)
+	}
+
+	err = b.DB.LeaveRoom(ctx, "general", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err = b.DB.GetRoomMembers(ctx, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(members, ","); got != "bob" {
+		t.Errorf("unexpected members %s", got)
+	}
+}
+
+func testHistory(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	page, err := b.History.GetMessages(ctx, "alice/bob", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 0 {
+		t.Errorf("empty conversation: unexpected messages %v", page)
+	}
+
+	sent := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		id, err := b.History.AppendMessage(ctx, "alice/bob", &db.Message{
+			From:      "alice",
+			To:        "bob",
+			Text:      fmt.Sprintf("message %d", i),
+			Time:      sent.Add(time.Duration(i) * time.Second),
+			MessageID: fmt.Sprintf("id%d", i),
+			Seq:       uint64(i),
+			Stream:    "laptop",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != int64(i) {
+			t.Errorf("message %d: unexpected ID %d", i, id)
+		}
+	}
+	_, err = b.History.AppendMessage(ctx, "alice/carol", &db.Message{From: "alice", To: "carol", Text: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		before int64
+		limit  int
+		ids    string
+	}{
+		{0, 2, "4,5"},
+		{0, 10, "1,2,3,4,5"},
+		{4, 2, "2,3"},
+		{2, 10, "1"},
+		{1, 10, ""},
+		{100, 1, "5"},
+	}
+	for _, test := range tests {
+		page, err := b.History.GetMessages(ctx, "alice/bob", test.before, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(page))
+		for i, m := range page {
+			ids[i] = fmt.Sprint(m.ID)
+		}
+		if got := strings.Join(ids, ","); got != test.ids {
+			t.Errorf("before %d, limit %d: expected IDs %s, got %s", test.before, test.limit, test.ids, got)
+		}
+	}
+
+	page, err = b.History.GetMessages(ctx, "alice/bob", 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := page[0]
+	if m.From != "alice" || m.To != "bob" || m.Text != "message 3" || !m.Time.Equal(sent.Add(3*time.Second)) ||
+		m.MessageID != "id3" || m.Seq != 3 || m.Stream != "laptop" {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
+func testInbox(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	known, err := b.Inbox.IsKnown(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if known {
+		t.Error("unknown user reported as known")
+	}
+	err = b.Inbox.MarkKnown(ctx, "bob", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known, err = b.Inbox.IsKnown(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !known {
+		t.Error("known user reported as unknown")
+	}
+
+	msgs, err := b.Inbox.DrainInbox(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("empty inbox: unexpected messages %v", msgs)
+	}
+	for _, text := range []string{"first", "second", "third"} {
+		err = b.Inbox.PushInbox(ctx, "bob", &db.Message{From: "alice", To: "bob", Text: text}, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, err = b.Inbox.DrainInbox(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := make([]string, len(msgs))
+	for i, m := range msgs {
+		texts[i] = m.Text
+	}
+	if got := strings.Join(texts, ","); got != "first,second,third" {
+		t.Errorf("unexpected messages %s", got)
+	}
+	msgs, err = b.Inbox.DrainInbox(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("drained inbox: unexpected messages %v", msgs)
+	}
+}
+
+func testInboxExpiry(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	ttl := 200 * time.Millisecond
+	err := b.Inbox.MarkKnown(ctx, "bob", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Inbox.PushInbox(ctx, "bob", &db.Message{From: "alice", To: "bob", Text: "lost"}, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * ttl)
+
+	known, err := b.Inbox.IsKnown(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if known {
+		t.Error("expired user reported as known")
+	}
+	msgs, err := b.Inbox.DrainInbox(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("expired inbox: unexpected messages %v", msgs)
+	}
+}
+
+func testPresence(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	_, err := b.Presence.GetPresence(ctx, "alice")
+	if errors.Cause(err) != db.ErrNotFound {
+		t.Errorf("unseen user: expected ErrNotFound, got %v", err)
+	}
+	seen := time.Date(2018, 3, 1, 12, 0, 0, 500, time.UTC)
+	err = b.Presence.SetPresence(ctx, "alice", &db.PresenceInfo{Status: "away", LastSeen: seen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := b.Presence.GetPresence(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != "away" || !p.LastSeen.Equal(seen) {
+		t.Errorf("unexpected presence %+v", p)
+	}
+
+	watchers := func(nickname, expected string) {
+		t.Helper()
+		w, err := b.Presence.GetWatchers(ctx, nickname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(w)
+		if got := strings.Join(w, ","); got != expected {
+			t.Errorf("\"%s\": expected watchers \"%s\", got \"%s\"", nickname, expected, got)
+		}
+	}
+	watchers("alice", "")
+	err = b.Presence.Watch(ctx, "bob", []string{"alice", "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Presence.Watch(ctx, "dave", []string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchers("alice", "bob,dave")
+	watchers("carol", "bob")
+
+	err = b.Presence.Unwatch(ctx, "dave", []string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchers("alice", "bob")
+	err = b.Presence.UnwatchAll(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchers("alice", "")
+	watchers("carol", "")
+}
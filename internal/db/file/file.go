@@ -0,0 +1,302 @@
+// Package file provides a db backend persisted in a local append-only file, for a single server.
+// The file is never compacted: it grows without limit, and is entirely replayed
+// each time the server starts.
+package file
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/nouney/fluxracine/internal/db/memory"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DB is a database kept in memory, whose changes are appended to a file and
+// replayed when it is opened again.
+// It implements db.DB, db.History, db.Inbox and db.Presence. The rooms, the history,
+// the offline inboxes and the presence survive restarts, the sessions do not: they
+// belong to the connections of the previous process.
+// The file is written without fsync: it survives the crashes of the process,
+// not the ones of the system.
+// Thread-safe.
+type DB struct {
+	*memory.DB
+	*memory.History
+	*memory.Inbox
+	*memory.Presence
+
+	// serializes the changes, so they are appended in the order they are applied
+	mutex sync.Mutex
+	f     *os.File
+}
+
+// operations of the records
+const (
+	opCreateRoom    = "create_room"
+	opJoinRoom      = "join_room"
+	opLeaveRoom     = "leave_room"
+	opAppendMessage = "append_message"
+	opMarkKnown     = "mark_known"
+	opPushInbox     = "push_inbox"
+	opDrainInbox    = "drain_inbox"
+	opSetPresence   = "set_presence"
+	opWatch         = "watch"
+	opUnwatch       = "unwatch"
+	opUnwatchAll    = "unwatch_all"
+)
+
+// record is a change, stored as a line of JSON.
+type record struct {
+	Op           string
+	Room         string           `json:",omitempty"`
+	Nickname     string           `json:",omitempty"`
+	Nicknames    []string         `json:",omitempty"`
+	Conversation string           `json:",omitempty"`
+	Message      *db.Message      `json:",omitempty"`
+	Presence     *db.PresenceInfo `json:",omitempty"`
+	// Expiry is the absolute date of the expiration given by a ttl
+	Expiry time.Time `json:",omitempty"`
+}
+
+// Open opens the database stored in the file path, creating it if needed.
+// A truncated last record, left by a crash, is dropped.
+func Open(path string) (*DB, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	d := &DB{
+		DB:       memory.NewDB(),
+		History:  memory.NewHistory(),
+		Inbox:    memory.NewInbox(),
+		Presence: memory.NewPresence(),
+		f:        f,
+	}
+	err = d.replay()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "replay \"%s\"", path)
+	}
+	return d, nil
+}
+
+// Close closes the file.
+func (d *DB) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.f.Close()
+}
+
+// replay applies the records of the file, then positions it at the end of the
+// last valid one.
+func (d *DB) replay() error {
+	r := bufio.NewReader(d.f)
+	var offset int64
+	n := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Warnf("db file: drop truncated record at offset %d", offset)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rec := &record{}
+		err = json.Unmarshal(line, rec)
+		if err != nil {
+			return errors.Wrapf(err, "record at offset %d", offset)
+		}
+		err = d.apply(rec)
+		if err != nil && err != db.ErrAlreadyExists && err != db.ErrNotFound {
+			return errors.Wrapf(err, "apply record at offset %d", offset)
+		}
+		offset += int64(len(line))
+		n++
+	}
+	log.Debugf("db file: %d records replayed", n)
+
+	err := d.f.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = d.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+// apply applies a change to the memory.
+func (d *DB) apply(rec *record) error {
+	switch rec.Op {
+	case opCreateRoom:
+		return d.DB.CreateRoom(context.Background(), rec.Room)
+	case opJoinRoom:
+		return d.DB.JoinRoom(context.Background(), rec.Room, rec.Nickname)
+	case opLeaveRoom:
+		return d.DB.LeaveRoom(context.Background(), rec.Room, rec.Nickname)
+	case opAppendMessage:
+		_, err := d.History.AppendMessage(context.Background(), rec.Conversation, rec.Message)
+		return err
+	case opMarkKnown:
+		return d.Inbox.MarkKnown(context.Background(), rec.Nickname, time.Until(rec.Expiry))
+	case opPushInbox:
+		return d.Inbox.PushInbox(context.Background(), rec.Nickname, rec.Message, time.Until(rec.Expiry))
+	case opDrainInbox:
+		_, err := d.Inbox.DrainInbox(context.Background(), rec.Nickname)
+		return err
+	case opSetPresence:
+		return d.Presence.SetPresence(context.Background(), rec.Nickname, rec.Presence)
+	case opWatch:
+		return d.Presence.Watch(context.Background(), rec.Nickname, rec.Nicknames)
+	case opUnwatch:
+		return d.Presence.Unwatch(context.Background(), rec.Nickname, rec.Nicknames)
+	case opUnwatchAll:
+		return d.Presence.UnwatchAll(context.Background(), rec.Nickname)
+	}
+	return errors.Errorf("unknown operation \"%s\"", rec.Op)
+}
+
+// change applies a change to the memory and appends it to the file if it succeeded.
+func (d *DB) change(rec *record) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	err := d.apply(rec)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = d.f.Write(append(b, '\n'))
+	return err
+}
+
+// CreateRoom creates an empty room.
+func (d *DB) CreateRoom(ctx context.Context, room string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.change(&record{Op: opCreateRoom, Room: room})
+}
+
+// JoinRoom adds a user to a room.
+func (d *DB) JoinRoom(ctx context.Context, room, nickname string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.change(&record{Op: opJoinRoom, Room: room, Nickname: nickname})
+}
+
+// LeaveRoom removes a user from a room.
+func (d *DB) LeaveRoom(ctx context.Context, room, nickname string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.change(&record{Op: opLeaveRoom, Room: room, Nickname: nickname})
+}
+
+// AppendMessage appends a message to a conversation and returns its ID.
+func (d *DB) AppendMessage(ctx context.Context, conversation string, m *db.Message) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// the ID is the position in the conversation, so it is the same once replayed
+	id, err := d.History.AppendMessage(ctx, conversation, m)
+	if err != nil {
+		return 0, err
+	}
+	b, err := json.Marshal(&record{Op: opAppendMessage, Conversation: conversation, Message: m})
+	if err != nil {
+		return 0, err
+	}
+	_, err = d.f.Write(append(b, '\n'))
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// MarkKnown remembers a user for ttl.
+func (d *DB) MarkKnown(ctx context.Context, nickname string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.change(&record{Op: opMarkKnown, Nickname: nickname, Expiry: time.Now().Add(ttl)})
+}
+
+// PushInbox queues a message for a user.
+func (d *DB) PushInbox(ctx context.Context, nickname string, m *db.Message, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.change(&record{Op: opPushInbox, Nickname: nickname, Message: m, Expiry: time.Now().Add(ttl)})
+}
+
+// DrainInbox retrieves and removes all the messages queued for a user.
+func (d *DB) DrainInbox(ctx context.Context, nickname string) ([]*db.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	msgs, err := d.Inbox.DrainInbox(ctx, nickname)
+	if err != nil || len(msgs) == 0 {
+		return msgs, err
+	}
+	b, err := json.Marshal(&record{Op: opDrainInbox, Nickname: nickname})
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.f.Write(append(b, '\n'))
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// SetPresence sets the presence status of a user.
+func (d *DB) SetPresence(ctx context.Context, nickname string, p *db.PresenceInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.change(&record{Op: opSetPresence, Nickname: nickname, Presence: p})
+}
+
+// Watch subscribes watcher to the presence changes of nicknames.
+func (d *DB) Watch(ctx context.Context, watcher string, nicknames []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.change(&record{Op: opWatch, Nickname: watcher, Nicknames: nicknames})
+}
+
+// Unwatch unsubscribes watcher from the presence changes of nicknames.
+func (d *DB) Unwatch(ctx context.Context, watcher string, nicknames []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.change(&record{Op: opUnwatch, Nickname: watcher, Nicknames: nicknames})
+}
+
+// UnwatchAll unsubscribes watcher from all the presence changes it watches.
+func (d *DB) UnwatchAll(ctx context.Context, watcher string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.change(&record{Op: opUnwatchAll, Nickname: watcher})
+}
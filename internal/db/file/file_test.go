@@ -0,0 +1,156 @@
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/nouney/fluxracine/internal/db/dbtest"
+)
+
+// tempDir creates a temporary directory and returns a function removing it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "webchat-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestConformance(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) (*dbtest.Backend, func()) {
+		dir, remove := tempDir(t)
+		d, err := Open(filepath.Join(dir, "webchat.db"))
+		if err != nil {
+			remove()
+			t.Fatal(err)
+		}
+		b := &dbtest.Backend{DB: d, History: d, Inbox: d, Presence: d}
+		return b, func() {
+			d.Close()
+			remove()
+		}
+	})
+}
+
+func TestReopen(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	path := filepath.Join(dir, "webchat.db")
+	ctx := context.Background()
+
+	d, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []error{
+		d.AddSession(ctx, "alice", db.Endpoint{Server: "10.0.0.1:8080", Session: "laptop"}, true),
+		d.CreateRoom(ctx, "general"),
+		d.JoinRoom(ctx, "general", "alice"),
+		d.JoinRoom(ctx, "general", "bob"),
+		d.LeaveRoom(ctx, "general", "bob"),
+		d.MarkKnown(ctx, "bob", time.Minute),
+		d.PushInbox(ctx, "bob", &db.Message{From: "alice", To: "bob", Text: "see you later"}, time.Minute),
+		d.SetPresence(ctx, "alice", &db.PresenceInfo{Status: "away"}),
+		d.Watch(ctx, "bob", []string{"alice"}),
+	}
+	_, err = d.AppendMessage(ctx, "alice/bob", &db.Message{From: "alice", To: "bob", Text: "hello"})
+	steps = append(steps, err)
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// the sessions belong to the previous process
+	_, err = d.GetSessions(ctx, "alice")
+	if err != db.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	members, err := d.GetRoomMembers(ctx, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0] != "alice" {
+		t.Errorf("unexpected members %v", members)
+	}
+	page, err := d.GetMessages(ctx, "alice/bob", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].ID != 1 || page[0].Text != "hello" {
+		t.Errorf("unexpected history %v", page)
+	}
+	known, err := d.IsKnown(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !known {
+		t.Error("known user forgotten")
+	}
+	msgs, err := d.DrainInbox(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Text != "see you later" {
+		t.Errorf("unexpected inbox %v", msgs)
+	}
+	p, err := d.GetPresence(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != "away" {
+		t.Errorf("unexpected presence %+v", p)
+	}
+	watchers, err := d.GetWatchers(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(watchers) != 1 || watchers[0] != "bob" {
+		t.Errorf("unexpected watchers %v", watchers)
+	}
+}
+
+func TestCanceled(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	path := filepath.Join(dir, "webchat.db")
+	d, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = d.AppendMessage(ctx, "alice/bob", &db.Message{From: "alice", To: "bob", Text: "hello"})
+	if err != context.Canceled {
+		t.Errorf("AppendMessage: expected context.Canceled, got %v", err)
+	}
+	_, err = d.DrainInbox(ctx, "bob")
+	if err != context.Canceled {
+		t.Errorf("DrainInbox: expected context.Canceled, got %v", err)
+	}
+	// nothing was written
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("unexpected file size %d", info.Size())
+	}
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// History stores the messages of the conversations.
+// A conversation is identified by an opaque string chosen by the caller.
+// All the methods give up with ctx.Err() once ctx is done.
+type History interface {
+	// AppendMessage appends a message to a conversation and returns its ID.
+	// IDs are positions in the conversation, starting at 1.
+	AppendMessage(ctx context.Context, conversation string, m *Message) (int64, error)
+	// GetMessages retrieves at most limit messages of a conversation with an ID lower than before,
+	// from the oldest to the newest. If before is 0, the latest messages are returned.
+	GetMessages(ctx context.Context, conversation string, before int64, limit int) ([]*Message, error)
+}
+
+// Message is a message stored in the history
+type Message struct {
+	ID   int64
+	From string
+	To   string
+	Room string
+	Text string
+	Time time.Time
+
+	// MessageID, Seq and Stream are the ones of the message when it was sent, ID
+	// is its position in the history
+	MessageID string `json:",omitempty"`
+	Seq       uint64 `json:",omitempty"`
+	Stream    string `json:",omitempty"`
+}
+
+// PageBounds computes the slice bounds [start:end) of the messages to return
+// from a conversation of size messages, for the given cursor and limit.
+func PageBounds(size, before int64, limit int) (int64, int64) {
+	end := size
+	if before > 0 && before-1 < end {
+		end = before - 1
+	}
+	start := end - int64(limit)
+	if start < 0 {
+		start = 0
+	}
+	return start, end
+}
@@ -0,0 +1,22 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Inbox stores the messages sent to users while they are offline.
+// All the methods give up with ctx.Err() once ctx is done.
+type Inbox interface {
+	// MarkKnown remembers a user for ttl, so messages can be queued for him
+	// while he is offline.
+	MarkKnown(ctx context.Context, nickname string, ttl time.Duration) error
+	// IsKnown checks if a user has been marked as known and has not expired yet.
+	IsKnown(ctx context.Context, nickname string) (bool, error)
+	// PushInbox queues a message for a user.
+	// The queue expires ttl after the last pushed message.
+	PushInbox(ctx context.Context, nickname string, m *Message, ttl time.Duration) error
+	// DrainInbox retrieves and removes all the messages queued for a user,
+	// from the oldest to the newest.
+	DrainInbox(ctx context.Context, nickname string) ([]*Message, error)
+}
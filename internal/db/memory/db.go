@@ -0,0 +1,145 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nouney/fluxracine/internal/db"
+)
+
+// DB is an in-memory database, for a single server.
+// Its calls never block: ctx is only checked when they start.
+// Thread-safe.
+type DB struct {
+	mutex sync.Mutex
+	// sessions of the users, by nickname
+	sessions map[string]map[db.Endpoint]bool
+	// members of the rooms, by room
+	rooms map[string]map[string]bool
+}
+
+// NewDB creates a new DB object.
+func NewDB() *DB {
+	return &DB{
+		sessions: make(map[string]map[db.Endpoint]bool),
+		rooms:    make(map[string]map[string]bool),
+	}
+}
+
+// AddSession registers a session of a user.
+func (d *DB) AddSession(ctx context.Context, nickname string, e db.Endpoint, exclusive bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if exclusive && len(d.sessions[nickname]) > 0 {
+		return db.ErrAlreadyExists
+	}
+	if d.sessions[nickname] == nil {
+		d.sessions[nickname] = make(map[db.Endpoint]bool)
+	}
+	d.sessions[nickname][e] = true
+	return nil
+}
+
+// GetSessions retrieves the sessions of a user.
+func (d *DB) GetSessions(ctx context.Context, nickname string) ([]db.Endpoint, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	sessions := d.sessions[nickname]
+	if len(sessions) == 0 {
+		return nil, db.ErrNotFound
+	}
+	endpoints := make([]db.Endpoint, 0, len(sessions))
+	for e := range sessions {
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+// RemoveSession un-registers a session of a user.
+func (d *DB) RemoveSession(ctx context.Context, nickname string, e db.Endpoint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.sessions[nickname], e)
+	if len(d.sessions[nickname]) == 0 {
+		delete(d.sessions, nickname)
+	}
+	return nil
+}
+
+// CreateRoom creates an empty room.
+func (d *DB) CreateRoom(ctx context.Context, room string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.rooms[room] != nil {
+		return db.ErrAlreadyExists
+	}
+	d.rooms[room] = make(map[string]bool)
+	return nil
+}
+
+// JoinRoom adds a user to a room.
+func (d *DB) JoinRoom(ctx context.Context, room, nickname string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	members := d.rooms[room]
+	if members == nil {
+		return db.ErrNotFound
+	}
+	members[nickname] = true
+	return nil
+}
+
+// LeaveRoom removes a user from a room.
+func (d *DB) LeaveRoom(ctx context.Context, room, nickname string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	members := d.rooms[room]
+	if members == nil {
+		return db.ErrNotFound
+	}
+	delete(members, nickname)
+	return nil
+}
+
+// GetRoomMembers retrieves the nicknames of the members of a room.
+func (d *DB) GetRoomMembers(ctx context.Context, room string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	members := d.rooms[room]
+	if members == nil {
+		return nil, db.ErrNotFound
+	}
+	nicknames := make([]string, 0, len(members))
+	for nickname := range members {
+		nicknames = append(nicknames, nickname)
+	}
+	return nicknames, nil
+}
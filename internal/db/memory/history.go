@@ -0,0 +1,56 @@
+// Package memory provides in-memory implementations of the db interfaces.
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nouney/fluxracine/internal/db"
+)
+
+// History is an in-memory message history.
+// Thread-safe.
+type History struct {
+	mutex         sync.Mutex
+	conversations map[string][]db.Message
+}
+
+// NewHistory creates a new History object.
+func NewHistory() *History {
+	return &History{
+		conversations: make(map[string][]db.Message),
+	}
+}
+
+// AppendMessage appends a message to a conversation and returns its ID.
+func (h *History) AppendMessage(ctx context.Context, conversation string, m *db.Message) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	msgs := append(h.conversations[conversation], *m)
+	id := int64(len(msgs))
+	msgs[id-1].ID = id
+	h.conversations[conversation] = msgs
+	return id, nil
+}
+
+// GetMessages retrieves at most limit messages of a conversation with an ID lower than before.
+func (h *History) GetMessages(ctx context.Context, conversation string, before int64, limit int) ([]*db.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	msgs := h.conversations[conversation]
+	start, end := db.PageBounds(int64(len(msgs)), before, limit)
+	page := make([]*db.Message, 0, end-start)
+	for i := start; i < end; i++ {
+		m := msgs[i]
+		page = append(page, &m)
+	}
+	return page, nil
+}
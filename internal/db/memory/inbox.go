@@ -0,0 +1,113 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+)
+
+// Inbox is an in-memory storage of the messages sent to offline users.
+// Expired entries are dropped lazily, when they are read.
+// Thread-safe.
+type Inbox struct {
+	mutex sync.Mutex
+	// expiry of the known users
+	known  map[string]time.Time
+	queues map[string]*queue
+}
+
+// queue is the messages queued for a user.
+type queue struct {
+	msgs   []db.Message
+	expiry time.Time
+}
+
+// NewInbox creates a new Inbox object.
+func NewInbox() *Inbox {
+	return &Inbox{
+		known:  make(map[string]time.Time),
+		queues: make(map[string]*queue),
+	}
+}
+
+// MarkKnown remembers a user for ttl.
+func (i *Inbox) MarkKnown(ctx context.Context, nickname string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.known[nickname] = time.Now().Add(ttl)
+	return nil
+}
+
+// IsKnown checks if a user has been marked as known.
+func (i *Inbox) IsKnown(ctx context.Context, nickname string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	expiry, ok := i.known[nickname]
+	if !ok {
+		return false, nil
+	}
+	if !time.Now().Before(expiry) {
+		delete(i.known, nickname)
+		return false, nil
+	}
+	return true, nil
+}
+
+// PushInbox queues a message for a user.
+func (i *Inbox) PushInbox(ctx context.Context, nickname string, m *db.Message, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	q := i.queue(nickname)
+	if q == nil {
+		q = &queue{}
+		i.queues[nickname] = q
+	}
+	q.msgs = append(q.msgs, *m)
+	q.expiry = time.Now().Add(ttl)
+	return nil
+}
+
+// DrainInbox retrieves and removes all the messages queued for a user.
+func (i *Inbox) DrainInbox(ctx context.Context, nickname string) ([]*db.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	q := i.queue(nickname)
+	delete(i.queues, nickname)
+	if q == nil {
+		return []*db.Message{}, nil
+	}
+	msgs := make([]*db.Message, len(q.msgs))
+	for j := range q.msgs {
+		msgs[j] = &q.msgs[j]
+	}
+	return msgs, nil
+}
+
+// queue returns the queue of a user, or nil if it does not exist or expired.
+// The caller must hold the lock.
+func (i *Inbox) queue(nickname string) *queue {
+	q := i.queues[nickname]
+	if q != nil && !time.Now().Before(q.expiry) {
+		delete(i.queues, nickname)
+		return nil
+	}
+	return q
+}
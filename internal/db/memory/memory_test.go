@@ -0,0 +1,19 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/nouney/fluxracine/internal/db/dbtest"
+)
+
+func TestConformance(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) (*dbtest.Backend, func()) {
+		b := &dbtest.Backend{
+			DB:       NewDB(),
+			History:  NewHistory(),
+			Inbox:    NewInbox(),
+			Presence: NewPresence(),
+		}
+		return b, func() {}
+	})
+}
@@ -0,0 +1,134 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nouney/fluxracine/internal/db"
+)
+
+// Presence is an in-memory storage of the presence of the users.
+// Thread-safe.
+type Presence struct {
+	mutex    sync.Mutex
+	statuses map[string]db.PresenceInfo
+	// users watching a user, by watched user
+	watchers map[string]map[string]bool
+	// users watched by a user, by watcher
+	watching map[string]map[string]bool
+}
+
+// NewPresence creates a new Presence object.
+func NewPresence() *Presence {
+	return &Presence{
+		statuses: make(map[string]db.PresenceInfo),
+		watchers: make(map[string]map[string]bool),
+		watching: make(map[string]map[string]bool),
+	}
+}
+
+// SetPresence sets the presence status of a user.
+func (p *Presence) SetPresence(ctx context.Context, nickname string, info *db.PresenceInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.statuses[nickname] = *info
+	return nil
+}
+
+// GetPresence retrieves the presence status of a user.
+func (p *Presence) GetPresence(ctx context.Context, nickname string) (*db.PresenceInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	info, ok := p.statuses[nickname]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	return &info, nil
+}
+
+// Watch subscribes watcher to the presence changes of nicknames.
+func (p *Presence) Watch(ctx context.Context, watcher string, nicknames []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, nickname := range nicknames {
+		if p.watchers[nickname] == nil {
+			p.watchers[nickname] = make(map[string]bool)
+		}
+		p.watchers[nickname][watcher] = true
+		if p.watching[watcher] == nil {
+			p.watching[watcher] = make(map[string]bool)
+		}
+		p.watching[watcher][nickname] = true
+	}
+	return nil
+}
+
+// Unwatch unsubscribes watcher from the presence changes of nicknames.
+func (p *Presence) Unwatch(ctx context.Context, watcher string, nicknames []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.unwatch(watcher, nicknames)
+	return nil
+}
+
+// UnwatchAll unsubscribes watcher from all the presence changes it watches.
+func (p *Presence) UnwatchAll(ctx context.Context, watcher string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	nicknames := make([]string, 0, len(p.watching[watcher]))
+	for nickname := range p.watching[watcher] {
+		nicknames = append(nicknames, nickname)
+	}
+	p.unwatch(watcher, nicknames)
+	return nil
+}
+
+// unwatch unsubscribes watcher from the presence changes of nicknames.
+// The caller must hold the lock.
+func (p *Presence) unwatch(watcher string, nicknames []string) {
+	for _, nickname := range nicknames {
+		delete(p.watchers[nickname], watcher)
+		if len(p.watchers[nickname]) == 0 {
+			delete(p.watchers, nickname)
+		}
+		delete(p.watching[watcher], nickname)
+	}
+	if len(p.watching[watcher]) == 0 {
+		delete(p.watching, watcher)
+	}
+}
+
+// GetWatchers retrieves the users subscribed to the presence changes of a user.
+func (p *Presence) GetWatchers(ctx context.Context, nickname string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	watchers := make([]string, 0, len(p.watchers[nickname]))
+	for watcher := range p.watchers[nickname] {
+		watchers = append(watchers, watcher)
+	}
+	return watchers, nil
+}
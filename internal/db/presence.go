@@ -0,0 +1,30 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Presence stores the presence of the users and who watches it.
+// All the methods give up with ctx.Err() once ctx is done.
+type Presence interface {
+	// SetPresence sets the presence status of a user.
+	SetPresence(ctx context.Context, nickname string, p *PresenceInfo) error
+	// GetPresence retrieves the presence status of a user.
+	// Returns ErrNotFound if the user has never been seen.
+	GetPresence(ctx context.Context, nickname string) (*PresenceInfo, error)
+	// Watch subscribes watcher to the presence changes of nicknames.
+	Watch(ctx context.Context, watcher string, nicknames []string) error
+	// Unwatch unsubscribes watcher from the presence changes of nicknames.
+	Unwatch(ctx context.Context, watcher string, nicknames []string) error
+	// UnwatchAll unsubscribes watcher from all the presence changes it watches.
+	UnwatchAll(ctx context.Context, watcher string) error
+	// GetWatchers retrieves the users subscribed to the presence changes of a user.
+	GetWatchers(ctx context.Context, nickname string) ([]string, error)
+}
+
+// PresenceInfo is the presence status of a user
+type PresenceInfo struct {
+	Status   string
+	LastSeen time.Time
+}
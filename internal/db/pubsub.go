@@ -0,0 +1,29 @@
+package db
+
+import "context"
+
+// PubSub is a publish/subscribe messaging system.
+// Publish and Subscribe give up with ctx.Err() once ctx is done.
+type PubSub interface {
+	// Publish sends a message to the subscribers of a channel.
+	// Returns the number of subscribers that received it, or UnknownReceivers if it
+	// cannot be known.
+	Publish(ctx context.Context, channel string, msg []byte) (int, error)
+	// Subscribe subscribes to a channel.
+	// The subscription is active when Subscribe returns. ctx only bounds the
+	// subscribing, not the subscription.
+	Subscribe(ctx context.Context, channel string) (Subscription, error)
+}
+
+// UnknownReceivers is returned by Publish when the number of subscribers that received
+// a message cannot be known.
+const UnknownReceivers = -1
+
+// Subscription receives the messages published to a channel.
+type Subscription interface {
+	// Next blocks until a message is received.
+	// Returns io.EOF once the subscription is closed.
+	Next() ([]byte, error)
+	// Close closes the subscription.
+	Close() error
+}
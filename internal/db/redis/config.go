@@ -0,0 +1,239 @@
+package redis
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+// Config is the configuration of the connection to redis.
+// The zero values of the timeouts and of the pool size are the defaults of go-redis.
+type Config struct {
+	// Addrs are the addresses of the server, of the sentinels if MasterName is set,
+	// or of some nodes of the cluster if Cluster is set.
+	Addrs []string
+	// MasterName is the name of the master monitored by the sentinels.
+	MasterName string
+	// Cluster connects to a Redis Cluster.
+	Cluster bool
+	// DB is the database to select. It must be 0 with a cluster.
+	DB       int
+	Password string
+	// TLSConfig enables TLS when set.
+	TLSConfig *tls.Config
+	// Prefix is prepended to all the keys and channels, DefaultPrefix if empty. It
+	// must not be a prefix of the one of another application sharing the same redis.
+	Prefix string
+
+	// PoolSize is the maximum number of connections, per node with a cluster.
+	PoolSize     int
+	PoolTimeout  time.Duration
+	IdleTimeout  time.Duration
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	MaxRetries   int
+}
+
+// ParseURL parses a configuration from an URL of the form:
+//
+//	redis[s]://[:password@]host[:port][,host[:port]...][/db][?option=value...]
+//
+// The scheme rediss enables TLS. Several hosts can be given, separated by commas or
+// with the option addr. The options are:
+//   - prefix: the prefix of the keys and channels, DefaultPrefix by default
+//   - sentinel: the name of the master, the hosts are then the sentinels
+//   - cluster: "true" to connect to a Redis Cluster
+//   - pool_size, max_retries: integers
+//   - pool_timeout, idle_timeout, dial_timeout, read_timeout, write_timeout: durations, e.g. "3s"
+//   - tls_server_name: the name checked against the certificates of the servers, by
+//     default the host of the server. It is required with sentinel or cluster, where
+//     all the servers are checked against it, unless tls_insecure_skip_verify is set
+//   - tls_insecure_skip_verify: "true" to skip the verification of the certificate
+func ParseURL(rawurl string) (*Config, error) {
+	// url.Parse rejects a list of hosts, so only the first one is given to it
+	rawurl, hosts := splitHosts(rawurl)
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, errors.Errorf("invalid redis URL scheme \"%s\"", u.Scheme)
+	}
+
+	cfg := &Config{}
+	if u.User != nil {
+		cfg.Password, _ = u.User.Password()
+	}
+	query := u.Query()
+	hosts = append(append([]string{u.Host}, hosts...), query["addr"]...)
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), "6379")
+		}
+		cfg.Addrs = append(cfg.Addrs, host)
+	}
+	if len(cfg.Addrs) == 0 {
+		return nil, errors.New("no redis host")
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		cfg.DB, err = strconv.Atoi(path)
+		if err != nil {
+			return nil, errors.Errorf("invalid redis database \"%s\"", path)
+		}
+	}
+
+	for name, values := range query {
+		value := values[len(values)-1]
+		switch name {
+		case "addr":
+		case "prefix":
+			cfg.Prefix = value
+		case "sentinel":
+			if value == "" {
+				return nil, errors.New("redis option \"sentinel\" requires the name of the master")
+			}
+			cfg.MasterName = value
+		case "cluster":
+			cfg.Cluster, err = strconv.ParseBool(value)
+		case "pool_size":
+			cfg.PoolSize, err = strconv.Atoi(value)
+		case "max_retries":
+			cfg.MaxRetries, err = strconv.Atoi(value)
+		case "pool_timeout":
+			cfg.PoolTimeout, err = time.ParseDuration(value)
+		case "idle_timeout":
+			cfg.IdleTimeout, err = time.ParseDuration(value)
+		case "dial_timeout":
+			cfg.DialTimeout, err = time.ParseDuration(value)
+		case "read_timeout":
+			cfg.ReadTimeout, err = time.ParseDuration(value)
+		case "write_timeout":
+			cfg.WriteTimeout, err = time.ParseDuration(value)
+		case "tls_server_name", "tls_insecure_skip_verify":
+		default:
+			return nil, errors.Errorf("unknown redis option \"%s\"", name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "redis option \"%s\"", name)
+		}
+	}
+
+	if u.Scheme == "rediss" {
+		cfg.TLSConfig = &tls.Config{ServerName: query.Get("tls_server_name")}
+		// with sentinel or cluster, the first host is only one of the servers
+		if cfg.TLSConfig.ServerName == "" && cfg.MasterName == "" && !cfg.Cluster {
+			cfg.TLSConfig.ServerName, _, _ = net.SplitHostPort(cfg.Addrs[0])
+		}
+		if skip := query.Get("tls_insecure_skip_verify"); skip != "" {
+			cfg.TLSConfig.InsecureSkipVerify, err = strconv.ParseBool(skip)
+			if err != nil {
+				return nil, errors.Wrap(err, "redis option \"tls_insecure_skip_verify\"")
+			}
+		}
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// splitHosts removes from an URL the hosts following the first one, and returns them.
+func splitHosts(rawurl string) (string, []string) {
+	i := strings.Index(rawurl, "://")
+	if i < 0 {
+		return rawurl, nil
+	}
+	start := i + len("://")
+	end := len(rawurl)
+	if j := strings.IndexAny(rawurl[start:], "/?#"); j >= 0 {
+		end = start + j
+	}
+	if j := strings.LastIndex(rawurl[start:end], "@"); j >= 0 {
+		start += j + 1
+	}
+	hosts := strings.Split(rawurl[start:end], ",")
+	return rawurl[:start] + hosts[0] + rawurl[end:], hosts[1:]
+}
+
+// validate checks that the options are consistent.
+func (cfg *Config) validate() error {
+	if len(cfg.Addrs) == 0 {
+		return errors.New("no redis address")
+	}
+	if cfg.Cluster && cfg.MasterName != "" {
+		return errors.New("redis sentinel and cluster are exclusive")
+	}
+	if cfg.Cluster && cfg.DB != 0 {
+		return errors.New("redis cluster only has the database 0")
+	}
+	if !cfg.Cluster && cfg.MasterName == "" && len(cfg.Addrs) > 1 {
+		return errors.New("several redis addresses require sentinel or cluster")
+	}
+	if cfg.TLSConfig != nil && cfg.TLSConfig.ServerName == "" && !cfg.TLSConfig.InsecureSkipVerify {
+		return errors.New("redis TLS requires a server name")
+	}
+	return nil
+}
+
+// newClient creates the client described by the configuration.
+func (cfg *Config) newClient() (redis.UniversalClient, error) {
+	err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.Cluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        cfg.Addrs,
+			Password:     cfg.Password,
+			TLSConfig:    cfg.TLSConfig,
+			PoolSize:     cfg.PoolSize,
+			PoolTimeout:  cfg.PoolTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
+			DialTimeout:  cfg.DialTimeout,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			MaxRetries:   cfg.MaxRetries,
+		}), nil
+	case cfg.MasterName != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cfg.MasterName,
+			SentinelAddrs: cfg.Addrs,
+			DB:            cfg.DB,
+			Password:      cfg.Password,
+			TLSConfig:     cfg.TLSConfig,
+			PoolSize:      cfg.PoolSize,
+			PoolTimeout:   cfg.PoolTimeout,
+			IdleTimeout:   cfg.IdleTimeout,
+			DialTimeout:   cfg.DialTimeout,
+			ReadTimeout:   cfg.ReadTimeout,
+			WriteTimeout:  cfg.WriteTimeout,
+			MaxRetries:    cfg.MaxRetries,
+		}), nil
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:         cfg.Addrs[0],
+		DB:           cfg.DB,
+		Password:     cfg.Password,
+		TLSConfig:    cfg.TLSConfig,
+		PoolSize:     cfg.PoolSize,
+		PoolTimeout:  cfg.PoolTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		DialTimeout:  cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		MaxRetries:   cfg.MaxRetries,
+	}), nil
+}
@@ -0,0 +1,153 @@
+package redis
+
+import (
+	"crypto/tls"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		url string
+		cfg *Config
+	}{
+		{"redis://localhost", &Config{Addrs: []string{"localhost:6379"}}},
+		{"redis://:secret@10.0.0.1:6380/2", &Config{Addrs: []string{"10.0.0.1:6380"}, Password: "secret", DB: 2}},
+		{"redis://[::1]", &Config{Addrs: []string{"[::1]:6379"}}},
+		{"redis://localhost?prefix=chat:", &Config{Addrs: []string{"localhost:6379"}, Prefix: "chat:"}},
+		{"rediss://redis.example.com", &Config{
+			Addrs:     []string{"redis.example.com:6379"},
+			TLSConfig: &tls.Config{ServerName: "redis.example.com"},
+		}},
+		{"rediss://10.0.0.1?tls_server_name=redis.example.com", &Config{
+			Addrs:     []string{"10.0.0.1:6379"},
+			TLSConfig: &tls.Config{ServerName: "redis.example.com"},
+		}},
+		{"rediss://10.0.0.1?tls_insecure_skip_verify=true", &Config{
+			Addrs:     []string{"10.0.0.1:6379"},
+			TLSConfig: &tls.Config{ServerName: "10.0.0.1", InsecureSkipVerify: true},
+		}},
+		{"redis://:secret@s1,s2:26380/1?sentinel=mymaster&addr=s3", &Config{
+			Addrs:      []string{"s1:6379", "s2:26380", "s3:6379"},
+			Password:   "secret",
+			MasterName: "mymaster",
+			DB:         1,
+		}},
+		{"redis://n1:7000,n2:7000?cluster=true", &Config{
+			Addrs:   []string{"n1:7000", "n2:7000"},
+			Cluster: true,
+		}},
+		{"redis://n1:7000?cluster=true&addr=n2:7000", &Config{
+			Addrs:   []string{"n1:7000", "n2:7000"},
+			Cluster: true,
+		}},
+		// with several servers, the first host is not the name of all of them
+		{"rediss://n1,n2?cluster=true&tls_server_name=redis.example.com", &Config{
+			Addrs:     []string{"n1:6379", "n2:6379"},
+			Cluster:   true,
+			TLSConfig: &tls.Config{ServerName: "redis.example.com"},
+		}},
+		{"rediss://s1,s2?sentinel=mymaster&tls_insecure_skip_verify=true", &Config{
+			Addrs:      []string{"s1:6379", "s2:6379"},
+			MasterName: "mymaster",
+			TLSConfig:  &tls.Config{InsecureSkipVerify: true},
+		}},
+		{"redis://localhost?pool_size=20&max_retries=3&pool_timeout=4s&idle_timeout=5m" +
+			"&dial_timeout=1s&read_timeout=2s&write_timeout=3s", &Config{
+			Addrs:        []string{"localhost:6379"},
+			PoolSize:     20,
+			MaxRetries:   3,
+			PoolTimeout:  4 * time.Second,
+			IdleTimeout:  5 * time.Minute,
+			DialTimeout:  time.Second,
+			ReadTimeout:  2 * time.Second,
+			WriteTimeout: 3 * time.Second,
+		}},
+	}
+	for _, test := range tests {
+		cfg, err := ParseURL(test.url)
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg, test.cfg) {
+			t.Errorf("%s: expected %+v, got %+v", test.url, test.cfg, cfg)
+		}
+	}
+}
+
+func TestParseURLErrors(t *testing.T) {
+	tests := []struct {
+		url string
+		err string
+	}{
+		{"http://localhost", "scheme"},
+		{"redis://", "no redis host"},
+		{"redis://localhost/abc", "database"},
+		// the database is only given by the path, and the master by sentinel
+		{"redis://localhost?db=2", "unknown redis option"},
+		{"redis://localhost?master=mymaster", "unknown redis option"},
+		{"redis://localhost?sentinel=", "name of the master"},
+		{"redis://n1,n2", "require sentinel or cluster"},
+		{"redis://n1/1?cluster=true", "database 0"},
+		{"redis://n1?cluster=true&sentinel=mymaster", "exclusive"},
+		{"redis://localhost?cluster=maybe", "cluster"},
+		{"redis://localhost?pool_size=many", "pool_size"},
+		{"redis://localhost?read_timeout=3", "read_timeout"},
+		{"rediss://n1,n2?cluster=true", "server name"},
+		{"rediss://localhost?tls_insecure_skip_verify=maybe", "tls_insecure_skip_verify"},
+	}
+	for _, test := range tests {
+		_, err := ParseURL(test.url)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing \"%s\", got %v", test.url, test.err, err)
+		}
+	}
+}
+
+func TestSplitHosts(t *testing.T) {
+	tests := []struct {
+		url   string
+		first string
+		hosts string
+	}{
+		{"redis://localhost", "redis://localhost", ""},
+		{"redis://a,b:6380,c/1?cluster=true", "redis://a/1?cluster=true", "b:6380,c"},
+		{"redis://:p@ss,word@a,b", "redis://:p@ss,word@a", "b"},
+		{"redis://a,b#fragment", "redis://a#fragment", "b"},
+		{"localhost,other", "localhost,other", ""},
+	}
+	for _, test := range tests {
+		first, hosts := splitHosts(test.url)
+		if first != test.first || strings.Join(hosts, ",") != test.hosts {
+			t.Errorf("%s: expected %s %s, got %s %v", test.url, test.first, test.hosts, first, hosts)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *Config
+		err  bool
+	}{
+		{"single", &Config{Addrs: []string{"localhost:6379"}, DB: 3}, false},
+		{"no address", &Config{}, true},
+		{"sentinel", &Config{Addrs: []string{"s1:26379", "s2:26379"}, MasterName: "mymaster", DB: 1}, false},
+		{"cluster", &Config{Addrs: []string{"n1:7000", "n2:7000"}, Cluster: true}, false},
+		{"cluster with a database", &Config{Addrs: []string{"n1:7000"}, Cluster: true, DB: 1}, true},
+		{"sentinel and cluster", &Config{Addrs: []string{"n1:7000"}, Cluster: true, MasterName: "mymaster"}, true},
+		{"several addresses", &Config{Addrs: []string{"a:6379", "b:6379"}}, true},
+		{"TLS", &Config{Addrs: []string{"a:6379"}, TLSConfig: &tls.Config{ServerName: "a"}}, false},
+		{"TLS without server name", &Config{Addrs: []string{"a:6379"}, TLSConfig: &tls.Config{}}, true},
+		{"TLS without verification", &Config{Addrs: []string{"a:6379"}, TLSConfig: &tls.Config{InsecureSkipVerify: true}}, false},
+	}
+	for _, test := range tests {
+		err := test.cfg.validate()
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package redis
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// keyPatterns match the keys of each type without their prefix, see the ...Key methods.
+var keyPatterns = []string{
+	"index:nodes",
+	"index:rooms",
+	"heartbeat:*",
+	"users:*",
+	"sessions:*",
+	"room:*",
+	"history:*",
+	"known:*",
+	"inbox:*",
+	"presence:*",
+	"watchers:*",
+	"watching:*",
+}
+
+// MigrateOptions are the options of MigrateKeys.
+type MigrateOptions struct {
+	// From is the prefix of the keys to move, "" for the versions without prefix.
+	From string
+	// DropLegacy deletes the keys of the oldest versions, which stored the server of
+	// each user as a string under its bare nickname, i.e. any other key under From
+	// whose value is a host:port address. They only referred to the connections of
+	// these versions.
+	DropLegacy bool
+	// MoveLegacy moves these keys to the sessions of the users instead, as a session
+	// on their server, which is removed once the server is purged. It is exclusive
+	// with DropLegacy.
+	MoveLegacy bool
+	// ConfirmUnprefixed confirms DropLegacy or MoveLegacy when From is "": the keys
+	// without prefix may belong to other applications sharing the same redis.
+	ConfirmUnprefixed bool
+	// DryRun only logs the changes.
+	DryRun bool
+}
+
+// MigrateStats are the numbers of keys handled by MigrateKeys.
+type MigrateStats struct {
+	Moved   int
+	Dropped int
+	// Skipped are the keys which already exist under the new prefix. They are left
+	// in place, under both prefixes.
+	Skipped int
+	// Ignored are the other keys under From which are not legacy sessions, when
+	// looking for them. They are left in place.
+	Ignored int
+}
+
+// MigrateKeys moves the keys of webchat from the prefix opts.From to the prefix of r.
+// The keys are copied with their ttl then deleted, one by one, so it also works
+// across the slots of a cluster. The chat servers must be stopped meanwhile.
+// Only the keys of the known types are moved: the ones of other applications
+// sharing the same prefix are left untouched.
+func (r Redis) MigrateKeys(opts MigrateOptions) (*MigrateStats, error) {
+	if opts.From == r.prefix {
+		return nil, errors.Errorf("the keys are already under the prefix \"%s\"", r.prefix)
+	}
+	legacy := opts.DropLegacy || opts.MoveLegacy
+	if opts.DropLegacy && opts.MoveLegacy {
+		return nil, errors.New("the legacy keys cannot be both dropped and moved")
+	}
+	if legacy && opts.From == "" && !opts.ConfirmUnprefixed {
+		return nil, errors.New("handling the legacy keys without prefix must be confirmed")
+	}
+
+	stats := &MigrateStats{}
+	for _, pattern := range keyPatterns {
+		err := r.scan(opts.From+pattern, func(c *redis.Client, key string) error {
+			return r.moveKey(c, key, r.prefix+strings.TrimPrefix(key, opts.From), opts.DryRun, stats)
+		})
+		if err != nil {
+			return stats, errors.Wrapf(err, "move the keys \"%s%s\"", opts.From, pattern)
+		}
+	}
+	if !legacy {
+		return stats, nil
+	}
+	err := r.scan(opts.From+"*", func(c *redis.Client, key string) error {
+		// the new prefix may be under the previous one
+		if len(r.prefix) > len(opts.From) && strings.HasPrefix(key, r.prefix) {
+			return nil
+		}
+		nickname := strings.TrimPrefix(key, opts.From)
+		if isWebchatKey(nickname) {
+			// already moved, or left in place by a dry run
+			return nil
+		}
+		return r.migrateLegacyKey(c, key, nickname, opts, stats)
+	})
+	if err != nil {
+		return stats, errors.Wrapf(err, "migrate the legacy keys \"%s*\"", opts.From)
+	}
+	return stats, nil
+}
+
+// isWebchatKey reports whether a key without prefix matches one of keyPatterns.
+func isWebchatKey(key string) bool {
+	for _, pattern := range keyPatterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// isAddr reports whether s is a host:port address.
+func isAddr(s string) bool {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host == "" {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// delIfEqualScript deletes the string KEYS[1] if its value is ARGV[1].
+var delIfEqualScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// migrateLegacyKey drops or moves key if it is the server of a user stored under
+// its bare nickname, i.e. a string holding a host:port address. Other keys are ignored.
+func (r Redis) migrateLegacyKey(c *redis.Client, key, nickname string, opts MigrateOptions, stats *MigrateStats) error {
+	typ, err := c.Type(key).Result()
+	if err != nil {
+		return err
+	}
+	if typ == "none" {
+		// deleted meanwhile
+		return nil
+	}
+	var addr string
+	if typ == "string" {
+		addr, err = c.Get(key).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if nickname == "" || !isAddr(addr) {
+		log.Warnf("ignore \"%s\": not a legacy session", key)
+		stats.Ignored++
+		return nil
+	}
+
+	if opts.MoveLegacy {
+		n, err := r.client.Exists(r.sessionsKey(nickname)).Result()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Warnf("skip \"%s\": \"%s\" already has sessions", key, nickname)
+			stats.Skipped++
+			return nil
+		}
+		log.Infof("move \"%s\", the legacy session of a user on \"%s\", to \"%s\"", key, addr, r.sessionsKey(nickname))
+		stats.Moved++
+	} else {
+		log.Infof("drop \"%s\", the legacy session of a user on \"%s\"", key, addr)
+		stats.Dropped++
+	}
+	if opts.DryRun {
+		return nil
+	}
+
+	if opts.MoveLegacy {
+		err = r.client.SAdd(r.sessionsKey(nickname), endpointMember(db.Endpoint{Server: addr})).Err()
+		if err != nil {
+			return err
+		}
+		err = r.client.SAdd(r.usersKey(addr), nickname).Err()
+		if err != nil {
+			return err
+		}
+	}
+	// the key is only deleted if it was not changed meanwhile
+	return delIfEqualScript.Run(c, []string{key}, addr).Err()
+}
+
+// scan calls f for each key matching pattern, with the client of the node holding it.
+// The nodes of a cluster are scanned concurrently, but f is called for one key at a time.
+func (r Redis) scan(pattern string, f func(c *redis.Client, key string) error) error {
+	var mutex sync.Mutex
+	scanNode := func(c *redis.Client) error {
+		// the keys are collected first, as moving them while scanning may return them twice
+		var keys []string
+		iter := c.Scan(0, pattern, 100).Iterator()
+		for iter.Next() {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			mutex.Lock()
+			err := f(c, key)
+			mutex.Unlock()
+			if err != nil {
+				return errors.Wrapf(err, "key \"%s\"", key)
+			}
+		}
+		return nil
+	}
+	switch c := r.client.(type) {
+	case *redis.Client:
+		return scanNode(c)
+	case *redis.ClusterClient:
+		return c.ForEachMaster(scanNode)
+	}
+	return errors.Errorf("unsupported redis client %T", r.client)
+}
+
+// moveKey moves the key src to dst, unless dst exists.
+// dst is written through r.client, as it may be on another node than src.
+func (r Redis) moveKey(c *redis.Client, src, dst string, dryRun bool, stats *MigrateStats) error {
+	n, err := r.client.Exists(dst).Result()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Warnf("skip \"%s\": \"%s\" already exists", src, dst)
+		stats.Skipped++
+		return nil
+	}
+	log.Infof("move \"%s\" to \"%s\"", src, dst)
+	stats.Moved++
+	if dryRun {
+		return nil
+	}
+
+	value, err := c.Dump(src).Result()
+	if err == redis.Nil {
+		// expired meanwhile
+		stats.Moved--
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ttl, err := c.PTTL(src).Result()
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		// no expiration
+		ttl = 0
+	}
+	err = r.client.Restore(dst, ttl, value).Err()
+	if err != nil {
+		return err
+	}
+	return c.Del(src).Err()
+}
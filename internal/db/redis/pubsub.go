@@ -0,0 +1,75 @@
+package redis
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/go-redis/redis"
+	"github.com/nouney/fluxracine/internal/db"
+)
+
+// Publish sends a message to the subscribers of a channel.
+// With a cluster, it returns db.UnknownReceivers: the message is broadcast to all the
+// nodes, but redis only counts the subscribers of the node it has been published on.
+func (r Redis) Publish(ctx context.Context, channel string, msg []byte) (int, error) {
+	var n int64
+	err := r.withContext(ctx, func(c redis.UniversalClient) error {
+		var err error
+		n, err = c.Publish(r.prefix+channel, msg).Result()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := r.client.(*redis.ClusterClient); ok {
+		return db.UnknownReceivers, nil
+	}
+	return int(n), nil
+}
+
+// Subscribe subscribes to a channel.
+func (r Redis) Subscribe(ctx context.Context, channel string) (db.Subscription, error) {
+	ps := r.client.Subscribe(r.prefix + channel)
+	// wait for the confirmation of the subscription
+	err := r.withContext(ctx, func(c redis.UniversalClient) error {
+		_, err := ps.Receive()
+		return err
+	})
+	if err != nil {
+		// also interrupts Receive if ctx is done
+		ps.Close()
+		return nil, err
+	}
+	return &subscription{ps: ps}, nil
+}
+
+// subscription is a redis subscription to a channel.
+type subscription struct {
+	ps     *redis.PubSub
+	mutex  sync.Mutex
+	closed bool
+}
+
+// Next blocks until a message is received.
+func (s *subscription) Next() ([]byte, error) {
+	msg, err := s.ps.ReceiveMessage()
+	if err != nil {
+		s.mutex.Lock()
+		closed := s.closed
+		s.mutex.Unlock()
+		if closed {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return []byte(msg.Payload), nil
+}
+
+// Close closes the subscription.
+func (s *subscription) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+	return s.ps.Close()
+}
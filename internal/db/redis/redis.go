@@ -1,53 +1,654 @@
 package redis
 
 import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
 	"github.com/go-redis/redis"
 	"github.com/nouney/fluxracine/internal/db"
 )
 
-// Redis is a redis client.
+// DefaultPrefix is the prefix of the keys and channels when none is configured.
+const DefaultPrefix = "webchat:"
+
+// Redis is a redis client, connected to a single server, to a master monitored by
+// sentinels or to a cluster.
+// All the keys of a command or of a script hash to the same slot, so they work with
+// a cluster. With a cluster, the transactions spanning several slots are split by
+// go-redis, so they are not atomic.
+// The keys are laid out as <prefix><type>:<id>, e.g. "webchat:sessions:alice", and the
+// channels as <prefix><channel>, so several applications can share the same redis.
 type Redis struct {
-	client *redis.Client
+	client redis.UniversalClient
+	prefix string
 }
 
-// New creates a new Redis client.
+// New creates a new Redis client connected to a single server.
 func New(addr, password string) (*Redis, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     addr,
+	return NewFromConfig(&Config{
+		Addrs:    []string{addr},
 		Password: password,
-		DB:       0,
 	})
-	_, err := client.Ping().Result()
+}
+
+// NewFromConfig creates a new Redis client from a configuration.
+func NewFromConfig(cfg *Config) (*Redis, error) {
+	client, err := cfg.newClient()
+	if err != nil {
+		return nil, err
+	}
+	_, err = client.Ping().Result()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	return &Redis{client: client, prefix: prefix}, nil
+}
+
+// Close closes the connections.
+func (r Redis) Close() error {
+	return r.client.Close()
+}
+
+// withContext runs f with the client bound to ctx, and gives up with ctx.Err() once
+// ctx is done. This version of go-redis does not interrupt the commands itself, so
+// f keeps running in background until it completes or the read timeout of the client expires.
+func (r Redis) withContext(ctx context.Context, f func(c redis.UniversalClient) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return f(r.client)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- f(r.bind(ctx))
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// bind returns the client bound to ctx.
+func (r Redis) bind(ctx context.Context) redis.UniversalClient {
+	switch c := r.client.(type) {
+	case *redis.Client:
+		return c.WithContext(ctx)
+	case *redis.ClusterClient:
+		return c.WithContext(ctx)
+	}
+	return r.client
+}
+
+// nodesKey returns the key of the set of all registered servers.
+func (r Redis) nodesKey() string {
+	return r.prefix + "index:nodes"
+}
+
+// heartbeatKey returns the key expiring when a server is dead.
+func (r Redis) heartbeatKey(addr string) string {
+	return r.prefix + "heartbeat:" + addr
+}
+
+// usersKey returns the key of the set of users having sessions on a server.
+func (r Redis) usersKey(addr string) string {
+	return r.prefix + "users:" + addr
+}
+
+// sessionsKey returns the key of the set of sessions of a user.
+func (r Redis) sessionsKey(nickname string) string {
+	return r.prefix + "sessions:" + nickname
+}
+
+// endpointMember returns the member of the set of sessions of a user identifying a session.
+// Session IDs cannot contain '@'.
+func endpointMember(e db.Endpoint) string {
+	return e.Session + "@" + e.Server
+}
+
+// parseEndpointMember is the opposite of endpointMember.
+func parseEndpointMember(member string) db.Endpoint {
+	i := strings.Index(member, "@")
+	if i < 0 {
+		return db.Endpoint{Server: member}
+	}
+	return db.Endpoint{Session: member[:i], Server: member[i+1:]}
+}
+
+// addSessionScript adds a session to the set KEYS[1], unless ARGV[2] is "1" and the set is not empty.
+var addSessionScript = redis.NewScript(`
+if ARGV[2] == "1" and redis.call("SCARD", KEYS[1]) > 0 then
+	return 0
+end
+redis.call("SADD", KEYS[1], ARGV[1])
+return 1
+`)
+
+// removeSessionScript removes a session from the set KEYS[1] and returns 1 if no
+// other session of the set is on the server ARGV[2].
+var removeSessionScript = redis.NewScript(`
+redis.call("SREM", KEYS[1], ARGV[1])
+for _, member in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+	if string.sub(member, -string.len(ARGV[2])) == ARGV[2] then
+		return 0
+	end
+end
+return 1
+`)
+
+// purgeSessionsScript removes the sessions of the set KEYS[1] on the server ARGV[1],
+// and returns the number of sessions left.
+var purgeSessionsScript = redis.NewScript(`
+for _, member in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+	if string.sub(member, -string.len(ARGV[1])) == ARGV[1] then
+		redis.call("SREM", KEYS[1], member)
+	end
+end
+return redis.call("SCARD", KEYS[1])
+`)
+
+// AddSession registers a session of a user.
+// The exclusivity check relies on a script so it is atomic across all chat servers.
+func (r Redis) AddSession(ctx context.Context, nickname string, e db.Endpoint, exclusive bool) error {
+	flag := "0"
+	if exclusive {
+		flag = "1"
+	}
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		n, err := addSessionScript.Run(c, []string{r.sessionsKey(nickname)}, endpointMember(e), flag).Result()
+		if err != nil {
+			return err
+		}
+		if n != int64(1) {
+			return db.ErrAlreadyExists
+		}
+		return c.SAdd(r.usersKey(e.Server), nickname).Err()
+	})
+}
+
+// GetSessions retrieves the sessions of a user, except the ones on dead servers.
+func (r Redis) GetSessions(ctx context.Context, nickname string) ([]db.Endpoint, error) {
+	var endpoints []db.Endpoint
+	err := r.withContext(ctx, func(c redis.UniversalClient) error {
+		var err error
+		endpoints, err = r.getSessions(c, nickname)
+		return err
+	})
+	return endpoints, err
+}
+
+// getSessions retrieves the sessions of a user, except the ones on dead servers.
+func (r Redis) getSessions(c redis.UniversalClient, nickname string) ([]db.Endpoint, error) {
+	members, err := c.SMembers(r.sessionsKey(nickname)).Result()
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]db.Endpoint, len(members))
+	for i, member := range members {
+		endpoints[i] = parseEndpointMember(member)
+	}
+
+	// servers which never registered are assumed alive
+	servers := db.Servers(endpoints)
+	registered := make([]*redis.BoolCmd, len(servers))
+	alive := make([]*redis.IntCmd, len(servers))
+	_, err = c.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, addr := range servers {
+			registered[i] = pipe.SIsMember(r.nodesKey(), addr)
+			alive[i] = pipe.Exists(r.heartbeatKey(addr))
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	dead := make(map[string]bool)
+	for i, addr := range servers {
+		if registered[i].Val() && alive[i].Val() == 0 {
+			dead[addr] = true
+		}
+	}
+
+	live := make([]db.Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if !dead[e.Server] {
+			live = append(live, e)
+		}
+	}
+	if len(live) == 0 {
+		return nil, db.ErrNotFound
+	}
+	return live, nil
+}
+
+// RemoveSession un-registers a session of a user.
+func (r Redis) RemoveSession(ctx context.Context, nickname string, e db.Endpoint) error {
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		n, err := removeSessionScript.Run(c, []string{r.sessionsKey(nickname)}, endpointMember(e), "@"+e.Server).Result()
+		if err != nil {
+			return err
+		}
+		if n == int64(1) {
+			return c.SRem(r.usersKey(e.Server), nickname).Err()
+		}
+		return nil
+	})
+}
+
+// RegisterNode registers a server, or refreshes its heartbeat, for ttl.
+func (r Redis) RegisterNode(ctx context.Context, addr string, ttl time.Duration) error {
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		_, err := c.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.SAdd(r.nodesKey(), addr)
+			pipe.Set(r.heartbeatKey(addr), time.Now().Unix(), ttl)
+			return nil
+		})
+		return err
+	})
+}
+
+// Nodes retrieves the registered servers which are alive.
+func (r Redis) Nodes(ctx context.Context) ([]string, error) {
+	alive, _, err := r.nodes(ctx)
+	return alive, err
+}
 
-	return &Redis{client: client}, nil
+// DeadNodes retrieves the registered servers whose heartbeat expired.
+func (r Redis) DeadNodes(ctx context.Context) ([]string, error) {
+	_, dead, err := r.nodes(ctx)
+	return dead, err
 }
 
-// AssignServer assigns a server to a user
-func (r Redis) AssignServer(nickname, addr string) error {
-	err := r.client.Set(nickname, addr, 0).Err()
+// nodes retrieves the registered servers, split between the alive and the dead ones.
+func (r Redis) nodes(ctx context.Context) ([]string, []string, error) {
+	alive, dead := []string{}, []string{}
+	err := r.withContext(ctx, func(c redis.UniversalClient) error {
+		nodes, err := c.SMembers(r.nodesKey()).Result()
+		if err != nil {
+			return err
+		}
+		exists := make([]*redis.IntCmd, len(nodes))
+		_, err = c.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, addr := range nodes {
+				exists[i] = pipe.Exists(r.heartbeatKey(addr))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, addr := range nodes {
+			if exists[i].Val() == 0 {
+				dead = append(dead, addr)
+			} else {
+				alive = append(alive, addr)
+			}
+		}
+		return nil
+	})
 	if err != nil {
+		return nil, nil, err
+	}
+	return alive, dead, nil
+}
+
+// PurgeNode un-registers a server and removes the sessions connected on it.
+func (r Redis) PurgeNode(ctx context.Context, addr string) ([]string, error) {
+	offline := []string{}
+	err := r.withContext(ctx, func(c redis.UniversalClient) error {
+		nicknames, err := c.SMembers(r.usersKey(addr)).Result()
+		if err != nil {
+			return err
+		}
+		for _, nickname := range nicknames {
+			n, err := purgeSessionsScript.Run(c, []string{r.sessionsKey(nickname)}, "@"+addr).Result()
+			if err != nil {
+				return err
+			}
+			if n == int64(0) {
+				offline = append(offline, nickname)
+			}
+		}
+		_, err = c.TxPipelined(func(pipe redis.Pipeliner) error {
+			// one key per command, they may not be in the same slot
+			pipe.Del(r.usersKey(addr))
+			pipe.Del(r.heartbeatKey(addr))
+			pipe.SRem(r.nodesKey(), addr)
+			return nil
+		})
 		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return offline, nil
+}
+
+// roomsKey returns the key of the set of all rooms.
+// Nicknames and room names cannot contain ':', so it never clashes with them.
+func (r Redis) roomsKey() string {
+	return r.prefix + "index:rooms"
+}
+
+// roomKey returns the key of the set of members of a room.
+func (r Redis) roomKey(room string) string {
+	return r.prefix + "room:" + room
+}
+
+// CreateRoom creates an empty room.
+func (r Redis) CreateRoom(ctx context.Context, room string) error {
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		n, err := c.SAdd(r.roomsKey(), room).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return db.ErrAlreadyExists
+		}
+		return nil
+	})
+}
+
+// JoinRoom adds a user to a room.
+func (r Redis) JoinRoom(ctx context.Context, room, nickname string) error {
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		err := r.checkRoom(c, room)
+		if err != nil {
+			return err
+		}
+		return c.SAdd(r.roomKey(room), nickname).Err()
+	})
+}
+
+// LeaveRoom removes a user from a room.
+func (r Redis) LeaveRoom(ctx context.Context, room, nickname string) error {
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		err := r.checkRoom(c, room)
+		if err != nil {
+			return err
+		}
+		return c.SRem(r.roomKey(room), nickname).Err()
+	})
+}
+
+// GetRoomMembers retrieves the nicknames of the members of a room.
+func (r Redis) GetRoomMembers(ctx context.Context, room string) ([]string, error) {
+	var members []string
+	err := r.withContext(ctx, func(c redis.UniversalClient) error {
+		err := r.checkRoom(c, room)
+		if err != nil {
+			return err
+		}
+		members, err = c.SMembers(r.roomKey(room)).Result()
+		return err
+	})
+	return members, err
+}
+
+// checkRoom returns db.ErrNotFound if the room does not exist.
+func (r Redis) checkRoom(c redis.UniversalClient, room string) error {
+	ok, err := c.SIsMember(r.roomsKey(), room).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return db.ErrNotFound
 	}
 	return nil
 }
 
-// GetServer retrieves the server associated to the user
-func (r Redis) GetServer(nickname string) (string, error) {
-	addr, err := r.client.Get(nickname).Result()
+// historyKey returns the key of the list of messages of a conversation.
+func (r Redis) historyKey(conversation string) string {
+	return r.prefix + "history:" + conversation
+}
+
+// AppendMessage appends a message to a conversation and returns its ID.
+func (r Redis) AppendMessage(ctx context.Context, conversation string, m *db.Message) (int64, error) {
+	b, err := json.Marshal(m)
 	if err != nil {
-		if err == redis.Nil {
-			return "", db.ErrNotFound
+		return 0, err
+	}
+	var id int64
+	err = r.withContext(ctx, func(c redis.UniversalClient) error {
+		var err error
+		id, err = c.RPush(r.historyKey(conversation), b).Result()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetMessages retrieves at most limit messages of a conversation with an ID lower than before.
+func (r Redis) GetMessages(ctx context.Context, conversation string, before int64, limit int) ([]*db.Message, error) {
+	key := r.historyKey(conversation)
+	var (
+		start, end int64
+		raws       []string
+	)
+	err := r.withContext(ctx, func(c redis.UniversalClient) error {
+		size, err := c.LLen(key).Result()
+		if err != nil {
+			return err
+		}
+		start, end = db.PageBounds(size, before, limit)
+		if start >= end {
+			return nil
 		}
-		return "", err
+		raws, err = c.LRange(key, start, end-1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page := make([]*db.Message, 0, len(raws))
+	for i, raw := range raws {
+		m := &db.Message{}
+		err = json.Unmarshal([]byte(raw), m)
+		if err != nil {
+			return nil, err
+		}
+		// IDs are not stored, they are positions in the list
+		m.ID = start + int64(i) + 1
+		page = append(page, m)
 	}
-	return addr, nil
+	return page, nil
 }
 
-// UnassignServer un-assigns a server from a user
-func (r Redis) UnassignServer(nickname string) error {
-	err := r.client.Del(nickname).Err()
-	return err
+// knownKey returns the key used to remember a user.
+func (r Redis) knownKey(nickname string) string {
+	return r.prefix + "known:" + nickname
+}
+
+// inboxKey returns the key of the list of messages queued for a user.
+func (r Redis) inboxKey(nickname string) string {
+	return r.prefix + "inbox:" + nickname
+}
+
+// MarkKnown remembers a user for ttl.
+func (r Redis) MarkKnown(ctx context.Context, nickname string, ttl time.Duration) error {
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		return c.Set(r.knownKey(nickname), 1, ttl).Err()
+	})
+}
+
+// IsKnown checks if a user has been marked as known.
+func (r Redis) IsKnown(ctx context.Context, nickname string) (bool, error) {
+	var n int64
+	err := r.withContext(ctx, func(c redis.UniversalClient) error {
+		var err error
+		n, err = c.Exists(r.knownKey(nickname)).Result()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// PushInbox queues a message for a user.
+func (r Redis) PushInbox(ctx context.Context, nickname string, m *db.Message, ttl time.Duration) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	key := r.inboxKey(nickname)
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		_, err := c.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.RPush(key, b)
+			pipe.Expire(key, ttl)
+			return nil
+		})
+		return err
+	})
+}
+
+// DrainInbox retrieves and removes all the messages queued for a user.
+func (r Redis) DrainInbox(ctx context.Context, nickname string) ([]*db.Message, error) {
+	key := r.inboxKey(nickname)
+	var lrange *redis.StringSliceCmd
+	err := r.withContext(ctx, func(c redis.UniversalClient) error {
+		_, err := c.TxPipelined(func(pipe redis.Pipeliner) error {
+			lrange = pipe.LRange(key, 0, -1)
+			pipe.Del(key)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*db.Message, 0, len(lrange.Val()))
+	for _, raw := range lrange.Val() {
+		m := &db.Message{}
+		err = json.Unmarshal([]byte(raw), m)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// presenceKey returns the key of the presence status of a user.
+func (r Redis) presenceKey(nickname string) string {
+	return r.prefix + "presence:" + nickname
+}
+
+// watchersKey returns the key of the set of users watching a user.
+func (r Redis) watchersKey(nickname string) string {
+	return r.prefix + "watchers:" + nickname
+}
+
+// watchingKey returns the key of the set of users watched by a user.
+func (r Redis) watchingKey(watcher string) string {
+	return r.prefix + "watching:" + watcher
+}
+
+// SetPresence sets the presence status of a user.
+func (r Redis) SetPresence(ctx context.Context, nickname string, p *db.PresenceInfo) error {
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		return c.HMSet(r.presenceKey(nickname), map[string]interface{}{
+			"status":    p.Status,
+			"last_seen": p.LastSeen.Format(time.RFC3339Nano),
+		}).Err()
+	})
+}
+
+// GetPresence retrieves the presence status of a user.
+func (r Redis) GetPresence(ctx context.Context, nickname string) (*db.PresenceInfo, error) {
+	var fields map[string]string
+	err := r.withContext(ctx, func(c redis.UniversalClient) error {
+		var err error
+		fields, err = c.HGetAll(r.presenceKey(nickname)).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, db.ErrNotFound
+	}
+	lastSeen, err := time.Parse(time.RFC3339Nano, fields["last_seen"])
+	if err != nil {
+		return nil, err
+	}
+	return &db.PresenceInfo{
+		Status:   fields["status"],
+		LastSeen: lastSeen,
+	}, nil
+}
+
+// Watch subscribes watcher to the presence changes of nicknames.
+func (r Redis) Watch(ctx context.Context, watcher string, nicknames []string) error {
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, nickname := range nicknames {
+				pipe.SAdd(r.watchersKey(nickname), watcher)
+				pipe.SAdd(r.watchingKey(watcher), nickname)
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+// Unwatch unsubscribes watcher from the presence changes of nicknames.
+func (r Redis) Unwatch(ctx context.Context, watcher string, nicknames []string) error {
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, nickname := range nicknames {
+				pipe.SRem(r.watchersKey(nickname), watcher)
+				pipe.SRem(r.watchingKey(watcher), nickname)
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+// UnwatchAll unsubscribes watcher from all the presence changes it watches.
+func (r Redis) UnwatchAll(ctx context.Context, watcher string) error {
+	return r.withContext(ctx, func(c redis.UniversalClient) error {
+		nicknames, err := c.SMembers(r.watchingKey(watcher)).Result()
+		if err != nil {
+			return err
+		}
+		_, err = c.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, nickname := range nicknames {
+				pipe.SRem(r.watchersKey(nickname), watcher)
+			}
+			pipe.Del(r.watchingKey(watcher))
+			return nil
+		})
+		return err
+	})
+}
+
+// GetWatchers retrieves the users subscribed to the presence changes of a user.
+func (r Redis) GetWatchers(ctx context.Context, nickname string) ([]string, error) {
+	var watchers []string
+	err := r.withContext(ctx, func(c redis.UniversalClient) error {
+		var err error
+		watchers, err = c.SMembers(r.watchersKey(nickname)).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return watchers, nil
 }
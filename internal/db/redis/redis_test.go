@@ -0,0 +1,157 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/nouney/fluxracine/internal/db/dbtest"
+)
+
+// testRedis connects to the redis given by REDIS_ADDR, under a prefix of its own,
+// and returns a function deleting the keys under the prefix.
+func testRedis(t *testing.T) (*Redis, func()) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	prefix := fmt.Sprintf("webchat-test-%d:", time.Now().UnixNano())
+	r, err := NewFromConfig(&Config{Addrs: []string{addr}, Prefix: prefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, func() {
+		err := r.scan(prefix+"*", func(c *redis.Client, key string) error {
+			return c.Del(key).Err()
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		r.Close()
+	}
+}
+
+func TestConformance(t *testing.T) {
+	if os.Getenv("REDIS_ADDR") == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	dbtest.Run(t, func(t *testing.T) (*dbtest.Backend, func()) {
+		r, release := testRedis(t)
+		b := &dbtest.Backend{DB: r, History: r, Inbox: r, Presence: r}
+		return b, release
+	})
+}
+
+func TestMigrateOptions(t *testing.T) {
+	r := &Redis{prefix: DefaultPrefix}
+	for _, opts := range []MigrateOptions{
+		{From: DefaultPrefix},
+		{DropLegacy: true},
+		{MoveLegacy: true},
+		{From: "old:", DropLegacy: true, MoveLegacy: true},
+	} {
+		if _, err := r.MigrateKeys(opts); err == nil {
+			t.Errorf("%+v accepted", opts)
+		}
+	}
+}
+
+// TestMigrateLegacy migrates the layout of the first version, a string holding
+// the server of each user under its bare nickname, here under the prefix of the
+// test. The new prefix is under it.
+func TestMigrateLegacy(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		opts     MigrateOptions
+		stats    MigrateStats
+		bare     string
+		sessions string
+	}{
+		{"dry run", MigrateOptions{DropLegacy: true, DryRun: true}, MigrateStats{Dropped: 2, Ignored: 3}, "alice,bob", ""},
+		{"drop", MigrateOptions{DropLegacy: true}, MigrateStats{Dropped: 2, Ignored: 3}, "", ""},
+		{"move", MigrateOptions{MoveLegacy: true}, MigrateStats{Moved: 1, Skipped: 1, Ignored: 3}, "bob", "10.0.0.1:8080/"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			legacy, release := testRedis(t)
+			defer release()
+			from := legacy.prefix
+			r := &Redis{client: legacy.client, prefix: from + "webchat:"}
+			for _, err := range []error{
+				r.client.Set(from+"alice", "10.0.0.1:8080", 0).Err(),
+				r.client.Set(from+"bob", "10.0.0.2:8080", 0).Err(),
+				// other applications
+				r.client.Set(from+"carol", "not an address", 0).Err(),
+				r.client.Set(from+"config:port", "8080", 0).Err(),
+				r.client.RPush(from+"queue", "10.0.0.1:8080").Err(),
+				// bob already connected with the new version
+				r.AddSession(ctx, "bob", db.Endpoint{Server: "10.0.0.3:8080", Session: "phone"}, false),
+			} {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			opts := test.opts
+			opts.From = from
+			stats, err := r.MigrateKeys(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *stats != test.stats {
+				t.Errorf("expected %+v, got %+v", test.stats, *stats)
+			}
+
+			var bare []string
+			for _, nickname := range []string{"alice", "bob"} {
+				n, err := r.client.Exists(from + nickname).Result()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n > 0 {
+					bare = append(bare, nickname)
+				}
+			}
+			if got := strings.Join(bare, ","); got != test.bare {
+				t.Errorf("expected the bare keys %s, got %s", test.bare, got)
+			}
+			for _, key := range []string{"carol", "config:port", "queue"} {
+				n, err := r.client.Exists(from + key).Result()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n == 0 {
+					t.Errorf("\"%s\" deleted", key)
+				}
+			}
+
+			sessions, err := r.GetSessions(ctx, "alice")
+			if err != nil && test.sessions != "" {
+				t.Fatal(err)
+			}
+			var got string
+			for _, e := range sessions {
+				got += e.Server + "/" + e.Session
+			}
+			if got != test.sessions {
+				t.Errorf("expected the sessions of alice %s, got %s", test.sessions, got)
+			}
+			if test.opts.MoveLegacy {
+				// the session is removed with its server
+				nicknames, err := r.PurgeNode(ctx, "10.0.0.1:8080")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fmt.Sprint(nicknames) != "[alice]" {
+					t.Errorf("unexpected purged users %v", nicknames)
+				}
+			}
+		})
+	}
+}
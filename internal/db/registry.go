@@ -0,0 +1,23 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Registry stores the servers of the cluster and their liveness.
+// A server is registered with a heartbeat that expires unless it is refreshed.
+// Once its heartbeat expired, a server is dead: DB.GetSessions must not return its
+// sessions anymore, and they are removed by PurgeNode.
+// All the methods give up with ctx.Err() once ctx is done.
+type Registry interface {
+	// RegisterNode registers a server, or refreshes its heartbeat, for ttl.
+	RegisterNode(ctx context.Context, server string, ttl time.Duration) error
+	// Nodes retrieves the registered servers which are alive.
+	Nodes(ctx context.Context) ([]string, error)
+	// DeadNodes retrieves the registered servers whose heartbeat expired.
+	DeadNodes(ctx context.Context) ([]string, error)
+	// PurgeNode un-registers a server and removes the sessions connected on it.
+	// It returns the nicknames of the users who have no session left.
+	PurgeNode(ctx context.Context, server string) ([]string, error)
+}
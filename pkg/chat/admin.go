@@ -0,0 +1,219 @@
+package chat
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminTimeout bounds the requests to the admin endpoints of the peers
+const adminTimeout = 5 * time.Second
+
+// AdminTransport is a Transport able to serve the admin endpoints on its HTTP server,
+// and to query the ones of the peers.
+type AdminTransport interface {
+	Transport
+	// ServeAdmin serves h on the paths starting with "/admin/".
+	ServeAdmin(h http.Handler)
+	// GetAdmin performs a GET request on the admin endpoint path of a peer,
+	// with the admin token, and decodes the JSON response into v.
+	GetAdmin(peer, path, token string, v interface{}) error
+}
+
+// NodeInfo describes a server of the cluster.
+type NodeInfo struct {
+	// ID is the address identifying the server in the cluster
+	ID        string
+	Version   string
+	StartedAt time.Time
+	Sessions  int
+	// Dropped is the number of messages dropped by the outboxes of the sessions
+	Dropped uint64
+}
+
+// SessionInfo describes a session connected on a server.
+type SessionInfo struct {
+	ID          string
+	Nickname    string
+	RemoteAddr  string
+	ConnectedAt time.Time
+}
+
+// NodeReport is the state of a server, as seen in the cluster view.
+type NodeReport struct {
+	Node     *NodeInfo      `json:",omitempty"`
+	Sessions []*SessionInfo `json:",omitempty"`
+	// Error is set if the server could not be queried
+	Error string `json:",omitempty"`
+}
+
+// WithAdmin enables the read-only admin endpoints, protected by token.
+// "/admin/node" describes the server, "/admin/sessions" lists its sessions and
+// "/admin/cluster" describes all the servers of the node registry with their sessions.
+// The transport must implement AdminTransport.
+func WithAdmin(token string) Opt {
+	return func(s *Server) error {
+		if token == "" {
+			return errors.New("admin: empty token")
+		}
+		s.adminToken = token
+		return nil
+	}
+}
+
+// WithVersion sets the version of the server, shown by the admin endpoints.
+func WithVersion(version string) Opt {
+	return func(s *Server) error {
+		s.version = version
+		return nil
+	}
+}
+
+// serveAdmin registers the admin endpoints on the transport.
+func (s *Server) serveAdmin() error {
+	if s.adminToken == "" {
+		return nil
+	}
+	t, ok := s.transport.(AdminTransport)
+	if !ok {
+		return errors.New("admin: transport does not support admin endpoints")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/node", s.adminNodeHandler)
+	mux.HandleFunc("/admin/sessions", s.adminSessionsHandler)
+	mux.HandleFunc("/admin/cluster", s.adminClusterHandler)
+	t.ServeAdmin(s.checkAdminToken(mux))
+	return nil
+}
+
+// checkAdminToken rejects the requests without the admin token.
+func (s *Server) checkAdminToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// NodeInfo describes this server.
+func (s *Server) NodeInfo() *NodeInfo {
+	return &NodeInfo{
+		ID:        s.httpAddr,
+		Version:   s.version,
+		StartedAt: s.startedAt,
+		Sessions:  s.NbSessions(),
+		Dropped:   s.DroppedMessages(),
+	}
+}
+
+// Sessions describes the sessions connected on this server, sorted by nickname and
+// connection date.
+func (s *Server) Sessions() []*SessionInfo {
+	sessions := s.localSessions()
+	infos := make([]*SessionInfo, len(sessions))
+	for i, sess := range sessions {
+		infos[i] = sess.info()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Nickname != infos[j].Nickname {
+			return infos[i].Nickname < infos[j].Nickname
+		}
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// Cluster describes all the alive servers of the node registry and their sessions.
+// Without registry, only this server is described.
+func (s *Server) Cluster(ctx context.Context) ([]*NodeReport, error) {
+	nodes := []string{s.httpAddr}
+	if s.registry != nil {
+		ctx, cancel := s.bind(ctx)
+		defer cancel()
+
+		var err error
+		nodes, err = s.registry.Nodes(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "registry")
+		}
+		if !contains(nodes, s.httpAddr) {
+			nodes = append(nodes, s.httpAddr)
+		}
+	}
+	sort.Strings(nodes)
+
+	reports := make([]*NodeReport, len(nodes))
+	wg := sync.WaitGroup{}
+	for i, node := range nodes {
+		if node == s.httpAddr {
+			reports[i] = &NodeReport{Node: s.NodeInfo(), Sessions: s.Sessions()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			reports[i] = s.queryNode(node)
+		}(i, node)
+	}
+	wg.Wait()
+	return reports, nil
+}
+
+// queryNode queries the admin endpoints of a peer.
+func (s *Server) queryNode(node string) *NodeReport {
+	t := s.transport.(AdminTransport)
+	report := &NodeReport{}
+	err := t.GetAdmin(node, "/admin/node", s.adminToken, &report.Node)
+	if err == nil {
+		err = t.GetAdmin(node, "/admin/sessions", s.adminToken, &report.Sessions)
+	}
+	if err != nil {
+		log.Warn(errors.Wrapf(err, "admin: query \"%s\"", node))
+		report.Node = &NodeInfo{ID: node}
+		report.Sessions = nil
+		report.Error = err.Error()
+	}
+	return report
+}
+
+func (s *Server) adminNodeHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.NodeInfo())
+}
+
+func (s *Server) adminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.Sessions())
+}
+
+func (s *Server) adminClusterHandler(w http.ResponseWriter, r *http.Request) {
+	reports, err := s.Cluster(r.Context())
+	if err != nil {
+		log.Error(errors.Wrap(err, "admin: cluster"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, reports)
+}
+
+// writeJSON writes v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Error(errors.Wrap(err, "json encode"))
+	}
+}
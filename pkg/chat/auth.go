@@ -0,0 +1,59 @@
+package chat
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrUnauthenticated is returned when the credentials of a user are missing or invalid.
+	ErrUnauthenticated = errors.New("unauthenticated")
+)
+
+// Authenticator verifies the identity of the users opening a session.
+type Authenticator interface {
+	// Authenticate returns the verified nickname of the user who sent the request.
+	// Must return ErrUnauthenticated (possibly wrapped) if the credentials are missing or invalid.
+	Authenticate(r *http.Request) (string, error)
+}
+
+// WithAuthenticator sets the authenticator used to identify the users.
+// Without it, users are anonymous and can choose any free nickname.
+func WithAuthenticator(a Authenticator) Opt {
+	return func(s *Server) error {
+		s.auth = a
+		return nil
+	}
+}
+
+// Authenticate identifies the user who sent the request. If nickname is not empty,
+// the user must be the one it designates.
+// It returns an empty nickname if no authenticator has been configured.
+func (s *Server) Authenticate(r *http.Request, nickname string) (string, error) {
+	if s.auth == nil {
+		return "", nil
+	}
+	verified, err := s.auth.Authenticate(r)
+	if err != nil {
+		return "", err
+	}
+	if verified == "" {
+		return "", ErrUnauthenticated
+	}
+	if nickname != "" && nickname != verified {
+		return "", errors.Wrap(ErrUnauthenticated, "nickname does not match the credentials")
+	}
+	return verified, nil
+}
+
+// bearerToken extracts the token from the "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(h, prefix)
+}
@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// StaticAuthenticator authenticates users with a nickname and a password,
+// checked against a fixed list of users.
+type StaticAuthenticator struct {
+	// bcrypt hashes of the passwords, by nickname
+	users map[string][]byte
+}
+
+// NewStaticAuthenticator creates a new StaticAuthenticator object from a users file.
+// Each line of the file is of form "nickname:hash", where hash is the bcrypt hash of
+// the password, e.g. generated with `htpasswd -nbB nickname password`. Empty lines and
+// lines starting with '#' are ignored.
+func NewStaticAuthenticator(path string) (*StaticAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+
+	a := &StaticAuthenticator{users: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("line %d: missing ':'", n)
+		}
+		hash := []byte(parts[1])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, errors.Errorf("line %d: invalid bcrypt hash", n)
+		}
+		a.users[parts[0]] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+	return a, nil
+}
+
+// Authenticate checks the nickname and password of the basic auth header of the request.
+func (a *StaticAuthenticator) Authenticate(r *http.Request) (string, error) {
+	nickname, password, ok := r.BasicAuth()
+	if !ok {
+		return "", errors.Wrap(ErrUnauthenticated, "missing credentials")
+	}
+
+	hash, ok := a.users[nickname]
+	if !ok {
+		return "", errors.Wrap(ErrUnauthenticated, "unknown user")
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", errors.Wrap(ErrUnauthenticated, "bad password")
+	}
+	return nickname, nil
+}
@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TokenAuthenticator authenticates users with HMAC-SHA256 signed bearer tokens.
+// A token is made of a base64 encoded JSON claim and its base64 encoded signature,
+// separated by a dot.
+type TokenAuthenticator struct {
+	secret []byte
+}
+
+// tokenClaims is the content of a token
+type tokenClaims struct {
+	// Nickname of the user
+	Sub string `json:"sub"`
+	// Expiration date, as a unix timestamp
+	Exp int64 `json:"exp"`
+}
+
+// NewTokenAuthenticator creates a new TokenAuthenticator object.
+func NewTokenAuthenticator(secret []byte) (*TokenAuthenticator, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	return &TokenAuthenticator{secret: secret}, nil
+}
+
+// Token creates a token for a user, valid during ttl.
+func (a *TokenAuthenticator) Token(nickname string, ttl time.Duration) (string, error) {
+	b, err := json.Marshal(&tokenClaims{
+		Sub: nickname,
+		Exp: time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "json marshal")
+	}
+	claims := base64.RawURLEncoding.EncodeToString(b)
+	return claims + "." + base64.RawURLEncoding.EncodeToString(a.sign(claims)), nil
+}
+
+// Authenticate returns the nickname contained in the bearer token of the request.
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (string, error) {
+	token := bearerToken(r)
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", errors.Wrap(ErrUnauthenticated, "malformed token")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, a.sign(parts[0])) {
+		return "", errors.Wrap(ErrUnauthenticated, "bad signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.Wrap(ErrUnauthenticated, "malformed claims")
+	}
+	claims := tokenClaims{}
+	err = json.Unmarshal(b, &claims)
+	if err != nil {
+		return "", errors.Wrap(ErrUnauthenticated, "malformed claims")
+	}
+	if time.Now().Unix() > claims.Exp {
+		return "", errors.Wrap(ErrUnauthenticated, "token expired")
+	}
+	return claims.Sub, nil
+}
+
+// sign computes the signature of the encoded claims.
+func (a *TokenAuthenticator) sign(claims string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(claims))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,100 @@
+package chat
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// bearerRequest returns a request carrying token as bearer token.
+func bearerRequest(token string) *http.Request {
+	r, _ := http.NewRequest("GET", "/", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	a, err := NewTokenAuthenticator([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewTokenAuthenticator([]byte("other secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(a *TokenAuthenticator, nickname string, ttl time.Duration) string {
+		token, err := a.Token(nickname, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	// signed returns a token made of claims and their valid signature
+	signed := func(claims string) string {
+		encoded := base64.RawURLEncoding.EncodeToString([]byte(claims))
+		return encoded + "." + base64.RawURLEncoding.EncodeToString(a.sign(encoded))
+	}
+	valid := token(a, "alice", time.Minute)
+	parts := strings.Split(valid, ".")
+	claims, sig := parts[0], parts[1]
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","exp":9999999999}`)) + "." + sig
+
+	tests := []struct {
+		name     string
+		token    string
+		nickname string
+	}{
+		{"valid", valid, "alice"},
+		{"missing", "", ""},
+		{"expired", token(a, "alice", -time.Minute), ""},
+		{"wrong secret", token(other, "alice", time.Minute), ""},
+		{"tampered claims", forged, ""},
+		{"no signature", claims, ""},
+		{"too many parts", valid + ".x", ""},
+		{"signature not base64", claims + ".!!!", ""},
+		{"claims not base64", "!!!." + base64.RawURLEncoding.EncodeToString(a.sign("!!!")), ""},
+		{"claims not JSON", signed("alice"), ""},
+	}
+	for _, test := range tests {
+		nickname, err := a.Authenticate(bearerRequest(test.token))
+		if test.nickname != "" {
+			if err != nil || nickname != test.nickname {
+				t.Errorf("%s: expected \"%s\", got \"%s\", %v", test.name, test.nickname, nickname, err)
+			}
+			continue
+		}
+		if errors.Cause(err) != ErrUnauthenticated {
+			t.Errorf("%s: expected ErrUnauthenticated, got \"%s\", %v", test.name, nickname, err)
+		}
+	}
+}
+
+func TestAuthenticateNickname(t *testing.T) {
+	a, err := NewTokenAuthenticator([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, WithAuthenticator(a))
+	token, err := a.Token("alice", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, requested := range []string{"", "alice"} {
+		nickname, err := s.Authenticate(bearerRequest(token), requested)
+		if err != nil || nickname != "alice" {
+			t.Errorf("requested \"%s\": expected \"alice\", got \"%s\", %v", requested, nickname, err)
+		}
+	}
+	// the subject of the token cannot be overridden
+	_, err = s.Authenticate(bearerRequest(token), "bob")
+	if errors.Cause(err) != ErrUnauthenticated {
+		t.Errorf("expected ErrUnauthenticated, got %v", err)
+	}
+}
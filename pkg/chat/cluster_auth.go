@@ -0,0 +1,205 @@
+package chat
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrBadSignature is returned when a message from a peer is not signed or not correctly signed.
+	ErrBadSignature = errors.New("bad signature")
+	// ErrReplay is returned when a signed message from a peer is too old or has already been received.
+	ErrReplay = errors.New("replayed message")
+)
+
+// TLSTransport is a Transport able to encrypt and authenticate its connections with TLS.
+type TLSTransport interface {
+	Transport
+	// UseTLS sets the TLS configuration used both to listen and to connect to the peers.
+	UseTLS(cfg *tls.Config)
+}
+
+// SigningTransport is a Transport able to sign the messages it sends and to
+// reject the unsigned ones it receives.
+type SigningTransport interface {
+	Transport
+	// UseSigner sets the signer of the messages.
+	UseSigner(s *ClusterSigner)
+}
+
+// WithClusterTLS enables mutual TLS between the servers of the cluster.
+// The transport must implement TLSTransport.
+func WithClusterTLS(cfg *tls.Config) Opt {
+	return func(s *Server) error {
+		s.clusterTLS = cfg
+		return nil
+	}
+}
+
+// WithClusterSecret enables the signing of the messages exchanged between the
+// servers of the cluster with a shared secret. Messages older than window are rejected.
+// The transport must implement SigningTransport.
+func WithClusterSecret(secret []byte, window time.Duration) Opt {
+	return func(s *Server) error {
+		signer, err := NewClusterSigner(secret, window)
+		if err != nil {
+			return err
+		}
+		s.clusterSigner = signer
+		return nil
+	}
+}
+
+// secureTransport passes the cluster security settings to the transport.
+func (s *Server) secureTransport() error {
+	if s.clusterTLS != nil {
+		t, ok := s.transport.(TLSTransport)
+		if !ok {
+			return errors.New("cluster tls: transport does not support tls")
+		}
+		t.UseTLS(s.clusterTLS)
+	}
+	if s.clusterSigner != nil {
+		t, ok := s.transport.(SigningTransport)
+		if !ok {
+			return errors.New("cluster secret: transport does not support signing")
+		}
+		t.UseSigner(s.clusterSigner)
+	}
+	return nil
+}
+
+// NewClusterTLSConfig creates a mutual TLS configuration: the server presents the
+// certificate certFile/keyFile, and both sides require a peer certificate signed by caFile.
+func NewClusterTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load key pair")
+	}
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read ca")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificate found in ca file")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClusterSigner signs the messages exchanged between servers with HMAC-SHA256 and a
+// shared secret. A signature covers a timestamp and a random nonce, so that a message
+// cannot be replayed: it is rejected if it is older than the window or if its nonce
+// has already been seen.
+// Thread-safe.
+type ClusterSigner struct {
+	secret []byte
+	window time.Duration
+
+	mutex sync.Mutex
+	// nonces seen during the window, with their expiration date
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+// Signature is the signature of a message.
+type Signature struct {
+	Timestamp int64
+	Nonce     string
+	MAC       string
+}
+
+// NewClusterSigner creates a new ClusterSigner object.
+func NewClusterSigner(secret []byte, window time.Duration) (*ClusterSigner, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cluster signer: empty secret")
+	}
+	// the timestamps have a resolution of one second
+	if window < time.Second {
+		return nil, errors.New("cluster signer: window must be at least one second")
+	}
+	return &ClusterSigner{
+		secret: secret,
+		window: window,
+		nonces: make(map[string]time.Time),
+	}, nil
+}
+
+// Sign signs a payload.
+func (c *ClusterSigner) Sign(payload []byte) (*Signature, error) {
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return nil, errors.Wrap(err, "rand")
+	}
+	sig := &Signature{
+		Timestamp: time.Now().Unix(),
+		Nonce:     hex.EncodeToString(b),
+	}
+	sig.MAC = hex.EncodeToString(c.mac(sig.Timestamp, sig.Nonce, payload))
+	return sig, nil
+}
+
+// Verify checks the signature of a payload.
+// Returns ErrBadSignature or ErrReplay if the payload must be rejected.
+func (c *ClusterSigner) Verify(payload []byte, sig *Signature) error {
+	if sig == nil || sig.Nonce == "" || sig.MAC == "" {
+		return ErrBadSignature
+	}
+	mac, err := hex.DecodeString(sig.MAC)
+	if err != nil || !hmac.Equal(mac, c.mac(sig.Timestamp, sig.Nonce, payload)) {
+		return ErrBadSignature
+	}
+
+	now := time.Now()
+	ts := time.Unix(sig.Timestamp, 0)
+	if ts.Before(now.Add(-c.window)) || ts.After(now.Add(c.window)) {
+		return ErrReplay
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if now.Sub(c.lastSweep) > c.window {
+		for nonce, expiry := range c.nonces {
+			if expiry.Before(now) {
+				delete(c.nonces, nonce)
+			}
+		}
+		c.lastSweep = now
+	}
+	if _, seen := c.nonces[sig.Nonce]; seen {
+		return ErrReplay
+	}
+	// the nonce must be remembered as long as the timestamp is accepted
+	c.nonces[sig.Nonce] = ts.Add(c.window)
+	return nil
+}
+
+// mac computes the MAC of a payload.
+func (c *ClusterSigner) mac(timestamp int64, nonce string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{'\n'})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,83 @@
+package chat
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestClusterSigner(t *testing.T) {
+	window := time.Minute
+	c, err := NewClusterSigner([]byte("secret"), window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewClusterSigner([]byte("other secret"), window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"message":"hello"}`)
+	sign := func(s *ClusterSigner) *Signature {
+		sig, err := s.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	// signedAt returns a valid signature of payload made at ts
+	signedAt := func(ts time.Time, nonce string) *Signature {
+		sig := &Signature{Timestamp: ts.Unix(), Nonce: nonce}
+		sig.MAC = hex.EncodeToString(c.mac(sig.Timestamp, sig.Nonce, payload))
+		return sig
+	}
+	replayed := sign(c)
+	if err := c.Verify(payload, replayed); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		sig     *Signature
+		err     error
+	}{
+		{"valid", payload, sign(c), nil},
+		{"within the window", payload, signedAt(time.Now().Add(-window/2), "past"), nil},
+		{"replayed", payload, replayed, ErrReplay},
+		{"too old", payload, signedAt(time.Now().Add(-2*window), "old"), ErrReplay},
+		{"in the future", payload, signedAt(time.Now().Add(2*window), "future"), ErrReplay},
+		{"tampered payload", []byte(`{"message":"bye"}`), sign(c), ErrBadSignature},
+		{"wrong secret", payload, sign(other), ErrBadSignature},
+		{"tampered nonce", payload, func() *Signature {
+			sig := sign(c)
+			sig.Nonce = "0123456789abcdef"
+			return sig
+		}(), ErrBadSignature},
+		{"tampered timestamp", payload, func() *Signature {
+			sig := sign(c)
+			sig.Timestamp++
+			return sig
+		}(), ErrBadSignature},
+		{"MAC not hex", payload, func() *Signature {
+			sig := sign(c)
+			sig.MAC = "not hex"
+			return sig
+		}(), ErrBadSignature},
+		{"no nonce", payload, signedAt(time.Now(), ""), ErrBadSignature},
+		{"no signature", payload, nil, ErrBadSignature},
+	}
+	for _, test := range tests {
+		err := c.Verify(test.payload, test.sig)
+		if err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestClusterSignerWindow(t *testing.T) {
+	// the timestamps have a resolution of one second
+	_, err := NewClusterSigner([]byte("secret"), 500*time.Millisecond)
+	if err == nil {
+		t.Error("window shorter than a second accepted")
+	}
+}
@@ -0,0 +1,49 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WithDBTimeout sets the timeout of the calls to the db which are not bound to
+// a request, e.g. when a session is closed by the server. By default, it is 5 seconds.
+func WithDBTimeout(d time.Duration) Opt {
+	return func(s *Server) error {
+		if d <= 0 {
+			return errors.New("db timeout must be positive")
+		}
+		s.dbTimeout = d
+		return nil
+	}
+}
+
+// baseContext returns the context cancelled when the server shuts down.
+func (s *Server) baseContext() context.Context {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.ctx
+}
+
+// bind returns a context done when ctx is, or when the server shuts down.
+// cancel must be called to release it.
+func (s *Server) bind(ctx context.Context) (context.Context, context.CancelFunc) {
+	base := s.baseContext()
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-base.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// backgroundContext returns a context for the calls to the db which are not bound
+// to a request. It expires after the db timeout, or when the server shuts down.
+func (s *Server) backgroundContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(s.baseContext(), s.dbTimeout)
+}
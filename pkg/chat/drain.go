@@ -0,0 +1,63 @@
+package chat
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrDraining is returned when a session is created on a server being drained.
+	ErrDraining = errors.New("server is draining")
+)
+
+// Reconnect asks a user to close his session and to reconnect, to another server, after Delay.
+type Reconnect struct {
+	Delay time.Duration
+}
+
+// Draining returns true if the server is being drained: it does not accept new sessions anymore.
+func (s *Server) Draining() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.draining
+}
+
+// Drain stops accepting new sessions and asks the connected users to reconnect.
+// The reconnection delays are spread between delay and twice delay, so that the other
+// servers are not flooded. Drain waits until all the users left, or until timeout,
+// then closes the remaining sessions.
+// The users keep their nickname: it is released when they leave this server.
+func (s *Server) Drain(delay, timeout time.Duration) {
+	s.mutex.Lock()
+	s.draining = true
+	s.mutex.Unlock()
+	sessions := s.localSessions()
+
+	log.Infof("drain %d sessions", len(sessions))
+	for _, sess := range sessions {
+		d := delay
+		if delay > 0 {
+			d += time.Duration(rand.Int63n(int64(delay)))
+		}
+		if !sess.outbox.push(&MessagePayload{
+			From:      s.systemSess.Nickname,
+			To:        sess.Nickname,
+			Reconnect: &Reconnect{Delay: d},
+		}, false) {
+			log.Debugf("reconnect of \"%s\" dropped", sess.Nickname)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for s.NbSessions() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := s.NbSessions(); n > 0 {
+		log.Warnf("drain timeout, close the %d remaining sessions", n)
+	}
+	s.CloseAllSessions()
+}
@@ -0,0 +1,70 @@
+package chat
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// fanOut sends a copy of a message to all the sessions of several users.
+// Recipients are grouped by server, so each remote server receives the message only once.
+// Recipients that are not connected are skipped.
+func (s *Server) fanOut(ctx context.Context, m *MessagePayload, recipients []string) error {
+	byServer := make(map[string][]string)
+	for _, to := range recipients {
+		servers, err := s.serversOf(ctx, to)
+		if err != nil {
+			if err == ErrUserNotFound {
+				continue
+			}
+			return err
+		}
+		for _, server := range servers {
+			byServer[server] = append(byServer[server], to)
+		}
+	}
+
+	for server, recipients := range byServer {
+		if server == s.httpAddr {
+			s.sendToUsers(m, recipients)
+			continue
+		}
+		err := s.forwardToUsers(ctx, server, m, recipients)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "forward message to \"%s\"", server))
+			for _, to := range recipients {
+				s.invalidateSessions(to)
+			}
+		}
+	}
+	return nil
+}
+
+// sendToUsers sends a copy of a message to several users connected on this server.
+// Users that are not connected anymore are ignored.
+func (s *Server) sendToUsers(m *MessagePayload, recipients []string) {
+	for _, to := range recipients {
+		err := s.sendToUser(to, addressedTo(m, to))
+		if err != nil && err != ErrUserNotFound {
+			log.Error(errors.Wrapf(err, "send to \"%s\"", to))
+		}
+	}
+}
+
+// addressedTo returns a copy of a message addressed to a recipient.
+// The echoes sent to the sender keep their original receiver.
+func addressedTo(m *MessagePayload, to string) *MessagePayload {
+	cpy := *m
+	if to != m.From {
+		cpy.To = to
+	}
+	return &cpy
+}
+
+// forwardToUsers forwards a message to a server, along with the list of
+// recipients connected on it.
+func (s *Server) forwardToUsers(ctx context.Context, server string, m *MessagePayload, recipients []string) error {
+	log.Debugf("forward message to \"%s\" for %d users", server, len(recipients))
+	return s.forward(ctx, server, m, recipients)
+}
@@ -0,0 +1,233 @@
+package chat
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrPeerTimeout is returned when the peer server did not answer in time.
+	ErrPeerTimeout = errors.New("peer timeout")
+	// ErrCircuitOpen is returned, without contacting the peer server, when it failed
+	// too many times recently.
+	ErrCircuitOpen = errors.New("peer circuit open")
+)
+
+// ForwardPolicy configures how the messages are forwarded to the other servers.
+type ForwardPolicy struct {
+	// Timeout bounds each attempt
+	Timeout time.Duration
+	// Retries is the number of attempts after the first one. Only idempotent
+	// deliveries are retried, and only after a transient failure.
+	Retries int
+	// Backoff is the delay before the first retry, doubled at each retry and jittered
+	Backoff time.Duration
+	// BreakerThreshold is the number of consecutive failures after which the
+	// circuit of a peer opens: forwarding to it fails fast with ErrCircuitOpen.
+	BreakerThreshold int
+	// BreakerCooldown is the time the circuit stays open, before a single
+	// delivery is tried again.
+	BreakerCooldown time.Duration
+}
+
+// DefaultForwardPolicy is the forwarding policy used by default.
+var DefaultForwardPolicy = ForwardPolicy{
+	Timeout:          5 * time.Second,
+	Retries:          2,
+	Backoff:          50 * time.Millisecond,
+	BreakerThreshold: 5,
+	BreakerCooldown:  10 * time.Second,
+}
+
+// WithForwardPolicy sets the policy used to forward the messages to the other servers.
+func WithForwardPolicy(p ForwardPolicy) Opt {
+	return func(s *Server) error {
+		if p.Timeout <= 0 || p.Retries < 0 || p.Backoff < 0 || p.BreakerThreshold <= 0 || p.BreakerCooldown <= 0 {
+			return errors.New("forward policy: invalid configuration")
+		}
+		s.forwardPolicy = p
+		return nil
+	}
+}
+
+// forward delivers a message to the recipients connected on a peer server, according
+// to the forwarding policy. The retries stop once ctx is done.
+func (s *Server) forward(ctx context.Context, peer string, m *MessagePayload, recipients []string) error {
+	p := s.forwardPolicy
+	attempts := 1
+	if idempotent(m) {
+		attempts += p.Retries
+	}
+
+	backoff := p.Backoff
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			// full jitter, so that the retries of the servers do not synchronize
+			if backoff > 0 {
+				timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff))))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return err
+				case <-timer.C:
+				}
+			}
+			backoff *= 2
+			log.Debugf("retry forward to \"%s\" (%d/%d)", peer, i, attempts-1)
+		}
+
+		if !s.breakers.allow(peer, p) {
+			return ErrCircuitOpen
+		}
+		err = s.deliverWithTimeout(ctx, peer, m, recipients, p.Timeout)
+		s.breakers.record(peer, p, err)
+		if !transient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// deliverWithTimeout delivers a message through the transport, giving up after timeout.
+func (s *Server) deliverWithTimeout(ctx context.Context, peer string, m *MessagePayload, recipients []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// the transport may read the message after the timeout
+	cpy := *m
+	err := s.transport.Deliver(ctx, peer, &cpy, recipients)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return ErrPeerTimeout
+	}
+	return err
+}
+
+// idempotent returns true if delivering a message twice is harmless: the servers drop
+// the duplicates of the messages having an ID, and presence updates and receipts are
+// states. Signals are never retried.
+func idempotent(m *MessagePayload) bool {
+	return m.Signal == nil && (m.ID != "" || m.Presence != nil || m.Receipt != nil)
+}
+
+// transient returns true if a delivery failed because of the peer server, and may
+// succeed later.
+func transient(err error) bool {
+	switch errors.Cause(err) {
+	case ErrPeerUnreachable, ErrPeerTimeout, ErrPeerUnavailable:
+		return true
+	}
+	return false
+}
+
+// breakers are the circuit breakers of the peer servers.
+// Thread-safe.
+type breakers struct {
+	mutex sync.Mutex
+	peers map[string]*breaker
+}
+
+// breaker is the circuit breaker of a peer server.
+type breaker struct {
+	failures int
+	// the circuit is open until this date
+	openUntil time.Time
+	// set while a single delivery checks if the peer recovered
+	probing bool
+}
+
+func newBreakers() *breakers {
+	return &breakers{peers: make(map[string]*breaker)}
+}
+
+// allow returns true if a delivery to the peer can be tried.
+func (b *breakers) allow(peer string, p ForwardPolicy) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	br := b.peers[peer]
+	if br == nil || br.failures < p.BreakerThreshold {
+		return true
+	}
+	if time.Now().Before(br.openUntil) || br.probing {
+		return false
+	}
+	br.probing = true
+	return true
+}
+
+// record updates the circuit of the peer with the outcome of a delivery.
+func (b *breakers) record(peer string, p ForwardPolicy, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !transient(err) {
+		delete(b.peers, peer)
+		return
+	}
+	br := b.peers[peer]
+	if br == nil {
+		br = &breaker{}
+		b.peers[peer] = br
+	}
+	br.failures++
+	br.probing = false
+	if br.failures >= p.BreakerThreshold {
+		if br.failures == p.BreakerThreshold {
+			log.Warnf("peer \"%s\" failed %d times, open its circuit", peer, br.failures)
+		}
+		br.openUntil = time.Now().Add(p.BreakerCooldown)
+	}
+}
+
+// dedupSize is the number of deliveries remembered to drop the duplicates
+const dedupSize = 4096
+
+// dedup remembers the last deliveries received from the peers, so that the retried
+// ones are not delivered twice.
+// Thread-safe.
+type dedup struct {
+	mutex sync.Mutex
+	seen  map[string]bool
+	// ring of the keys of seen, next is the oldest one
+	order []string
+	next  int
+}
+
+func newDedup() *dedup {
+	return &dedup{
+		seen:  make(map[string]bool),
+		order: make([]string, dedupSize),
+	}
+}
+
+// filter returns the recipients who did not already receive the message.
+func (d *dedup) filter(m *MessagePayload, recipients []string) []string {
+	if m.ID == "" {
+		return recipients
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	fresh := make([]string, 0, len(recipients))
+	for _, to := range recipients {
+		key := m.ID + "\x00" + to
+		if d.seen[key] {
+			log.Debugf("drop duplicate of message \"%s\" to \"%s\"", m.ID, to)
+			continue
+		}
+		fresh = append(fresh, to)
+
+		delete(d.seen, d.order[d.next])
+		d.seen[key] = true
+		d.order[d.next] = key
+		d.next = (d.next + 1) % len(d.order)
+	}
+	return fresh
+}
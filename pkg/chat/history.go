@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// HistoryDefaultLimit is the number of messages returned when no limit is given
+	HistoryDefaultLimit = 20
+	// HistoryMaxLimit is the maximum number of messages returned at once
+	HistoryMaxLimit = 100
+)
+
+var (
+	// ErrHistoryDisabled is returned when the server has no history storage.
+	ErrHistoryDisabled = errors.New("history disabled")
+)
+
+// WithHistory sets the storage used to keep the messages.
+// Without it, messages are not stored.
+func WithHistory(h db.History) Opt {
+	return func(s *Server) error {
+		s.history = h
+		return nil
+	}
+}
+
+// History returns the messages exchanged between nickname and peer, older than
+// the message of ID before (all if 0). Messages are sorted from the oldest to the newest.
+func (s *Server) History(ctx context.Context, nickname, peer string, before int64, limit int) ([]*db.Message, error) {
+	return s.getHistory(ctx, conversationID(nickname, peer), before, limit)
+}
+
+// RoomHistory returns the messages sent to a room, older than the message of
+// ID before (all if 0). The user must be a member of the room.
+func (s *Server) RoomHistory(ctx context.Context, nickname, room string, before int64, limit int) ([]*db.Message, error) {
+	members, err := s.RoomMembers(ctx, room)
+	if err != nil {
+		return nil, err
+	}
+	if !contains(members, nickname) {
+		return nil, ErrNotRoomMember
+	}
+	return s.getHistory(ctx, roomConversationID(room), before, limit)
+}
+
+// getHistory retrieves a page of a conversation.
+func (s *Server) getHistory(ctx context.Context, conversation string, before int64, limit int) ([]*db.Message, error) {
+	if s.history == nil {
+		return nil, ErrHistoryDisabled
+	}
+	if limit <= 0 {
+		limit = HistoryDefaultLimit
+	}
+	if limit > HistoryMaxLimit {
+		limit = HistoryMaxLimit
+	}
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	msgs, err := s.history.GetMessages(ctx, conversation, before, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "history")
+	}
+	return msgs, nil
+}
+
+// record appends a delivered message to the history.
+// Messages sent by SYSTEM are not recorded.
+func (s *Server) record(ctx context.Context, m *MessagePayload) {
+	if s.history == nil || m.From == s.systemSess.Nickname {
+		return
+	}
+
+	conversation := conversationID(m.From, m.To)
+	if m.Room != "" {
+		conversation = roomConversationID(m.Room)
+	}
+	_, err := s.history.AppendMessage(ctx, conversation, &db.Message{
+		MessageID: m.ID,
+		Seq:       m.Seq,
+		Stream:    m.Stream,
+		From:      m.From,
+		To:        m.To,
+		Room:      m.Room,
+		Text:      m.Message,
+		Time:      time.Now().UTC(),
+	})
+	if err != nil {
+		log.Error(errors.Wrap(err, "append to history"))
+	}
+}
+
+// conversationID returns the ID of the conversation between two users.
+// It does not depend on the order of the users.
+func conversationID(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return "user:" + a + ":" + b
+}
+
+// roomConversationID returns the ID of the conversation of a room.
+func roomConversationID(room string) string {
+	return "room:" + room
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// difference returns the elements of a which are not in b.
+func difference(a, b []string) []string {
+	d := make([]string, 0, len(a))
+	for _, e := range a {
+		if !contains(b, e) {
+			d = append(d, e)
+		}
+	}
+	return d
+}
@@ -0,0 +1,98 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// WithOfflineInbox enables the offline inbox: messages sent to a known user
+// who is not connected are queued and delivered when he connects again.
+// Users are known during ttl after their last connection, and queued
+// messages are dropped ttl after they have been sent.
+func WithOfflineInbox(inbox db.Inbox, ttl time.Duration) Opt {
+	return func(s *Server) error {
+		if ttl <= 0 {
+			return errors.New("offline inbox: ttl must be positive")
+		}
+		s.inbox = inbox
+		s.inboxTTL = ttl
+		return nil
+	}
+}
+
+// markKnown remembers a user so messages can be queued for him while he is offline.
+func (s *Server) markKnown(ctx context.Context, nickname string) {
+	if s.inbox == nil {
+		return
+	}
+	err := s.inbox.MarkKnown(ctx, nickname, s.inboxTTL)
+	if err != nil {
+		log.Error(errors.Wrap(err, "inbox: mark known"))
+	}
+}
+
+// storeOffline queues a message for a user who is not connected.
+// Returns ErrUserNotFound if the inbox is disabled or if the user is unknown.
+func (s *Server) storeOffline(ctx context.Context, m *MessagePayload) error {
+	if s.inbox == nil {
+		return ErrUserNotFound
+	}
+	known, err := s.inbox.IsKnown(ctx, m.To)
+	if err != nil {
+		return errors.Wrap(err, "inbox")
+	}
+	if !known {
+		return ErrUserNotFound
+	}
+
+	err = s.inbox.PushInbox(ctx, m.To, &db.Message{
+		MessageID: m.ID,
+		Seq:       m.Seq,
+		Stream:    m.Stream,
+		From:      m.From,
+		To:        m.To,
+		Text:      m.Message,
+		Time:      time.Now().UTC(),
+	}, s.inboxTTL)
+	if err != nil {
+		return errors.Wrap(err, "inbox")
+	}
+	log.Debugf("user \"%s\" is offline, message queued", m.To)
+	s.systemSess.SendMessage(ctx, m.From, fmt.Sprintf("user \"%s\" is offline, the message will be delivered later", m.To))
+	return nil
+}
+
+// drainInbox moves the messages queued while the user was offline into its session.
+func (s *Server) drainInbox(ctx context.Context, sess *Session) {
+	if s.inbox == nil {
+		return
+	}
+	msgs, err := s.inbox.DrainInbox(ctx, sess.Nickname)
+	if err != nil {
+		log.Error(errors.Wrap(err, "inbox: drain"))
+		return
+	}
+
+	expiry := time.Now().UTC().Add(-s.inboxTTL)
+	pending := make([]*MessagePayload, 0, len(msgs))
+	for _, m := range msgs {
+		if m.Time.Before(expiry) {
+			continue
+		}
+		pending = append(pending, &MessagePayload{
+			ID:      m.MessageID,
+			Seq:     m.Seq,
+			Stream:  m.Stream,
+			From:    m.From,
+			To:      m.To,
+			Message: m.Text,
+		})
+	}
+	log.Debugf("%d offline messages for user \"%s\"", len(pending), sess.Nickname)
+	sess.addPending(pending)
+}
@@ -0,0 +1,55 @@
+package chat
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// NicknameMinLength is the minimum length of a nickname
+	NicknameMinLength = 2
+	// NicknameMaxLength is the maximum length of a nickname
+	NicknameMaxLength = 32
+)
+
+var (
+	// ErrNicknameTaken is returned when the requested nickname is used by someone else.
+	ErrNicknameTaken = errors.New("nickname taken")
+	// ErrInvalidNickname is returned when the requested nickname does not respect the rules.
+	ErrInvalidNickname = errors.New("invalid nickname")
+
+	// reserved nicknames, compared case-insensitively
+	reservedNicknames = map[string]bool{
+		"system": true,
+	}
+)
+
+// ValidateNickname checks that a nickname can be used by a user.
+// A valid nickname is made of letters, digits, '-' and '_', is between
+// NicknameMinLength and NicknameMaxLength characters long and is not reserved.
+func ValidateNickname(nickname string) error {
+	err := validateName(nickname)
+	if err != nil {
+		return errors.Wrap(ErrInvalidNickname, err.Error())
+	}
+	if reservedNicknames[strings.ToLower(nickname)] {
+		return errors.Wrap(ErrInvalidNickname, "reserved")
+	}
+	return nil
+}
+
+// validateName checks the length and the charset of a name (nickname, room...).
+func validateName(name string) error {
+	if len(name) < NicknameMinLength || len(name) > NicknameMaxLength {
+		return errors.Errorf("length must be between %d and %d", NicknameMinLength, NicknameMaxLength)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return errors.Errorf("forbidden character %q", c)
+		}
+	}
+	return nil
+}
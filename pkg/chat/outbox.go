@@ -0,0 +1,168 @@
+package chat
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// OverflowPolicy tells what to do when a message is sent to a session whose outbox is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest drops the oldest message of the outbox to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// DropNewest drops the new message
+	DropNewest
+	// Disconnect closes the outbox, the slow client is then disconnected
+	Disconnect
+)
+
+var (
+	// ErrSlowConsumer is returned by ReceiveMessage when the session has been
+	// disconnected because it did not read its messages fast enough.
+	ErrSlowConsumer = errors.New("slow consumer")
+)
+
+// WithOutbox sets the capacity of the outbox of each session and what to do when it is full.
+func WithOutbox(capacity int, policy OverflowPolicy) Opt {
+	return func(s *Server) error {
+		if capacity <= 0 {
+			return errors.New("outbox: capacity must be positive")
+		}
+		s.outboxCapacity = capacity
+		s.outboxPolicy = policy
+		return nil
+	}
+}
+
+// outbox is the queue of the messages waiting to be read by a session.
+// Pushing never blocks, and pushing to a closed outbox is a no-op.
+// Thread-safe.
+type outbox struct {
+	mutex    sync.Mutex
+	queue    []*MessagePayload
+	capacity int
+	policy   OverflowPolicy
+	closed   bool
+	// set if the outbox has been closed because of an overflow
+	evicted bool
+	// signaled when a message is pushed or the outbox is closed
+	notify chan struct{}
+	// number of dropped messages, also added to the server-wide counter
+	dropped      uint64
+	totalDropped *uint64
+}
+
+func newOutbox(capacity int, policy OverflowPolicy, totalDropped *uint64) *outbox {
+	return &outbox{
+		queue:        make([]*MessagePayload, 0, capacity),
+		capacity:     capacity,
+		policy:       policy,
+		notify:       make(chan struct{}, 1),
+		totalDropped: totalDropped,
+	}
+}
+
+// push adds a message to the outbox.
+// Lossy messages are dropped if the outbox is full, whatever the policy.
+// Returns false if the message has been dropped.
+func (o *outbox) push(m *MessagePayload, lossy bool) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.closed {
+		o.drop(1)
+		return false
+	}
+	if len(o.queue) >= o.capacity {
+		switch {
+		case lossy || o.policy == DropNewest:
+			o.drop(1)
+			return false
+		case o.policy == DropOldest:
+			o.queue = o.queue[1:]
+			o.drop(1)
+		case o.policy == Disconnect:
+			o.drop(uint64(len(o.queue)) + 1)
+			o.queue = nil
+			o.evicted = true
+			o.closeLocked()
+			return false
+		}
+	}
+	o.queue = append(o.queue, m)
+	o.signal()
+	return true
+}
+
+// pop removes the oldest message of the outbox, waiting for one until deadline fires.
+// It returns nil if the deadline fired, and io.EOF or ErrSlowConsumer once the
+// outbox is closed and empty.
+func (o *outbox) pop(deadline <-chan time.Time) (*MessagePayload, error) {
+	for {
+		o.mutex.Lock()
+		if len(o.queue) > 0 {
+			m := o.queue[0]
+			o.queue[0] = nil
+			o.queue = o.queue[1:]
+			o.mutex.Unlock()
+			return m, nil
+		}
+		closed, evicted := o.closed, o.evicted
+		o.mutex.Unlock()
+
+		if evicted {
+			return nil, ErrSlowConsumer
+		}
+		if closed {
+			return nil, io.EOF
+		}
+
+		select {
+		case <-o.notify:
+		case <-deadline:
+			return nil, nil
+		}
+	}
+}
+
+// close closes the outbox, waking up the reader.
+// Messages already queued can still be read.
+func (o *outbox) close() {
+	o.mutex.Lock()
+	o.closeLocked()
+	o.mutex.Unlock()
+}
+
+func (o *outbox) closeLocked() {
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.signal()
+}
+
+// signal wakes up the reader, without blocking.
+func (o *outbox) signal() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// drop counts dropped messages.
+func (o *outbox) drop(n uint64) {
+	o.dropped += n
+	atomic.AddUint64(o.totalDropped, n)
+}
+
+// droppedCount returns the number of messages dropped by this outbox.
+func (o *outbox) droppedCount() uint64 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.dropped
+}
@@ -0,0 +1,112 @@
+package chat
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// drain pops the messages of an outbox until it is empty, and returns their text
+// with the error ending the reading, nil if the outbox is still open.
+func drain(o *outbox) (string, error) {
+	var texts []string
+	for {
+		deadline := make(chan time.Time)
+		close(deadline)
+		m, err := o.pop(deadline)
+		if m == nil {
+			return strings.Join(texts, ","), err
+		}
+		texts = append(texts, m.Message)
+	}
+}
+
+func TestOutboxOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  OverflowPolicy
+		pushed  string
+		kept    string
+		dropped uint64
+		err     error
+	}{
+		{"drop oldest", DropOldest, "1,2,3,4,5", "3,4,5", 2, nil},
+		{"drop newest", DropNewest, "1,2,3,4,5", "1,2,3", 2, nil},
+		{"disconnect", Disconnect, "1,2,3,4,5", "", 5, ErrSlowConsumer},
+		{"not full", Disconnect, "1,2,3", "1,2,3", 0, nil},
+	}
+	for _, test := range tests {
+		var total uint64
+		o := newOutbox(3, test.policy, &total)
+		var accepted []string
+		for _, text := range strings.Split(test.pushed, ",") {
+			if o.push(&MessagePayload{Message: text}, false) {
+				accepted = append(accepted, text)
+			}
+		}
+		kept, err := drain(o)
+		if kept != test.kept || err != test.err {
+			t.Errorf("%s: expected \"%s\", %v, got \"%s\", %v", test.name, test.kept, test.err, kept, err)
+		}
+		if o.droppedCount() != test.dropped || total != test.dropped {
+			t.Errorf("%s: expected %d dropped, got %d, %d in total", test.name, test.dropped, o.droppedCount(), total)
+		}
+		if test.policy == DropNewest && strings.Join(accepted, ",") != test.kept {
+			t.Errorf("%s: unexpected accepted messages %v", test.name, accepted)
+		}
+	}
+}
+
+func TestOutboxLossy(t *testing.T) {
+	var total uint64
+	o := newOutbox(2, Disconnect, &total)
+	o.push(&MessagePayload{Message: "1"}, false)
+	o.push(&MessagePayload{Message: "typing"}, true)
+	// lossy messages are dropped when the outbox is full, whatever the policy
+	if o.push(&MessagePayload{Message: "typing"}, true) {
+		t.Error("lossy message pushed to a full outbox")
+	}
+	kept, err := drain(o)
+	if kept != "1,typing" || err != nil {
+		t.Errorf("unexpected messages \"%s\", %v", kept, err)
+	}
+	if total != 1 {
+		t.Errorf("expected 1 dropped, got %d", total)
+	}
+}
+
+func TestOutboxClose(t *testing.T) {
+	var total uint64
+	o := newOutbox(2, DropOldest, &total)
+	o.push(&MessagePayload{Message: "1"}, false)
+
+	// the reader is woken up by the pushed messages
+	done := make(chan *MessagePayload)
+	go func() {
+		m, _ := o.pop(nil)
+		done <- m
+	}()
+	select {
+	case m := <-done:
+		if m.Message != "1" {
+			t.Errorf("unexpected message %+v", m)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("pop blocked")
+	}
+
+	// the queued messages are still read once closed
+	o.push(&MessagePayload{Message: "2"}, false)
+	o.close()
+	if o.push(&MessagePayload{Message: "3"}, false) {
+		t.Error("message pushed to a closed outbox")
+	}
+	kept, err := drain(o)
+	if kept != "2" || err != io.EOF {
+		t.Errorf("expected \"2\", EOF, got \"%s\", %v", kept, err)
+	}
+	if total != 1 {
+		t.Errorf("expected 1 dropped, got %d", total)
+	}
+}
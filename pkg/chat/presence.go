@@ -0,0 +1,158 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// PresenceStatus is the presence status of a user
+type PresenceStatus string
+
+const (
+	// PresenceOnline is the status of a connected user
+	PresenceOnline PresenceStatus = "online"
+	// PresenceAway is the status of a connected user who is not active
+	PresenceAway PresenceStatus = "away"
+	// PresenceOffline is the status of a disconnected user
+	PresenceOffline PresenceStatus = "offline"
+)
+
+var (
+	// ErrPresenceDisabled is returned when the server has no presence storage.
+	ErrPresenceDisabled = errors.New("presence disabled")
+	// ErrInvalidPresence is returned when a user sets an unknown presence status.
+	ErrInvalidPresence = errors.New("invalid presence status")
+)
+
+// PresenceUpdate is the presence of a user, sent to the users watching him.
+type PresenceUpdate struct {
+	Nickname string
+	Status   PresenceStatus
+	// LastSeen is the last time the status of the user changed
+	LastSeen time.Time
+}
+
+// WithPresence enables the presence tracking, using p as storage.
+func WithPresence(p db.Presence) Opt {
+	return func(s *Server) error {
+		s.presence = p
+		return nil
+	}
+}
+
+// SetPresence sets the presence status of a connected user and notifies his watchers.
+// Only PresenceOnline and PresenceAway can be set, PresenceOffline is set when the session is closed.
+func (s *Server) SetPresence(ctx context.Context, nickname string, status PresenceStatus) error {
+	if s.presence == nil {
+		return ErrPresenceDisabled
+	}
+	if status != PresenceOnline && status != PresenceAway {
+		return ErrInvalidPresence
+	}
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	return s.updatePresence(ctx, nickname, status)
+}
+
+// WatchPresence subscribes watcher to the presence changes of nicknames.
+// It returns the current presence of each of them.
+func (s *Server) WatchPresence(ctx context.Context, watcher string, nicknames []string) ([]*PresenceUpdate, error) {
+	if s.presence == nil {
+		return nil, ErrPresenceDisabled
+	}
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	err := s.presence.Watch(ctx, watcher, nicknames)
+	if err != nil {
+		return nil, errors.Wrap(err, "presence")
+	}
+
+	updates := make([]*PresenceUpdate, 0, len(nicknames))
+	for _, nickname := range nicknames {
+		update := &PresenceUpdate{
+			Nickname: nickname,
+			Status:   PresenceOffline,
+		}
+		p, err := s.presence.GetPresence(ctx, nickname)
+		if err != nil && err != db.ErrNotFound {
+			return nil, errors.Wrap(err, "presence")
+		}
+		if err == nil {
+			update.Status = PresenceStatus(p.Status)
+			update.LastSeen = p.LastSeen
+		}
+		updates = append(updates, update)
+	}
+	return updates, nil
+}
+
+// UnwatchPresence unsubscribes watcher from the presence changes of nicknames.
+func (s *Server) UnwatchPresence(ctx context.Context, watcher string, nicknames []string) error {
+	if s.presence == nil {
+		return ErrPresenceDisabled
+	}
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	err := s.presence.Unwatch(ctx, watcher, nicknames)
+	if err != nil {
+		return errors.Wrap(err, "presence")
+	}
+	return nil
+}
+
+// updatePresence stores the presence of a user and sends it to his watchers,
+// wherever they are connected.
+func (s *Server) updatePresence(ctx context.Context, nickname string, status PresenceStatus) error {
+	update := &PresenceUpdate{
+		Nickname: nickname,
+		Status:   status,
+		LastSeen: time.Now().UTC(),
+	}
+	err := s.presence.SetPresence(ctx, nickname, &db.PresenceInfo{
+		Status:   string(update.Status),
+		LastSeen: update.LastSeen,
+	})
+	if err != nil {
+		return errors.Wrap(err, "presence")
+	}
+
+	watchers, err := s.presence.GetWatchers(ctx, nickname)
+	if err != nil {
+		return errors.Wrap(err, "presence")
+	}
+	return s.fanOut(ctx, &MessagePayload{
+		From:     s.systemSess.Nickname,
+		Presence: update,
+	}, watchers)
+}
+
+// trackPresence updates the presence of a user when his session is opened or closed.
+// Errors are only logged.
+func (s *Server) trackPresence(ctx context.Context, nickname string, status PresenceStatus) {
+	if s.presence == nil {
+		return
+	}
+	err := s.updatePresence(ctx, nickname, status)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "set presence of \"%s\" to %s", nickname, status))
+	}
+}
+
+// unwatchAll unsubscribes a user from all the presence changes he watches, once
+// he has no session left.
+func (s *Server) unwatchAll(ctx context.Context, nickname string) {
+	if s.presence == nil {
+		return
+	}
+	err := s.presence.UnwatchAll(ctx, nickname)
+	if err != nil {
+		log.Error(errors.Wrap(err, "presence: unwatch"))
+	}
+}
@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownMessage is returned when a read receipt is sent for a message which has
+// not been delivered to the session.
+var ErrUnknownMessage = errors.New("unknown message")
+
+// deliveredSetSize is the number of the last messages delivered to a session which
+// can be marked as read.
+const deliveredSetSize = 1024
+
+// ReceiptStatus is the status of a message reported by a receipt
+type ReceiptStatus string
+
+const (
+	// ReceiptDelivered means that the message has been written to the receiver's client
+	ReceiptDelivered ReceiptStatus = "delivered"
+	// ReceiptRead means that the receiver has read the message
+	ReceiptRead ReceiptStatus = "read"
+)
+
+// Receipt informs the sender of a message about its status.
+type Receipt struct {
+	MessageID string
+	// By is the receiver of the message
+	By     string
+	Status ReceiptStatus
+}
+
+// deliveredSet holds the last messages delivered to a session, by sender and ID.
+// The oldest ones are forgotten once it is full. Thread-safe.
+type deliveredSet struct {
+	keys  map[string]bool
+	order []string
+	// next is the position of the oldest key in order once it is full
+	next  int
+	mutex sync.Mutex
+}
+
+func newDeliveredSet(size int) *deliveredSet {
+	return &deliveredSet{
+		keys:  make(map[string]bool, size),
+		order: make([]string, 0, size),
+	}
+}
+
+func deliveredKey(from, id string) string {
+	return from + "\x00" + id
+}
+
+// add records that the message id from from has been delivered.
+func (d *deliveredSet) add(from, id string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	key := deliveredKey(from, id)
+	if d.keys[key] {
+		return
+	}
+	if len(d.order) < cap(d.order) {
+		d.order = append(d.order, key)
+	} else {
+		delete(d.keys, d.order[d.next])
+		d.order[d.next] = key
+		d.next = (d.next + 1) % len(d.order)
+	}
+	d.keys[key] = true
+}
+
+// contains returns whether the message id from from has been delivered.
+func (d *deliveredSet) contains(from, id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.keys[deliveredKey(from, id)]
+}
+
+// newMessageID generates a random message ID.
+func newMessageID() (string, error) {
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", errors.Wrap(err, "rand")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SendReceipt sends a receipt to the sender of a message, wherever he is connected.
+// Receipts are only sent for one-to-one text messages sent by users.
+// If the sender is not connected anymore, the receipt is dropped.
+func (s *Server) SendReceipt(ctx context.Context, m *MessagePayload, status ReceiptStatus) error {
+	if m.ID == "" || m.Room != "" || m.Presence != nil || m.Receipt != nil || m.Signal != nil || m.From == s.systemSess.Nickname {
+		return nil
+	}
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	return s.fanOut(ctx, &MessagePayload{
+		From: s.systemSess.Nickname,
+		Receipt: &Receipt{
+			MessageID: m.ID,
+			By:        m.To,
+			Status:    status,
+		},
+	}, []string{m.From})
+}
@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// WithNodeRegistry registers the server in r with a heartbeat expiring after ttl.
+// The heartbeat is refreshed while the server runs. Each server also reaps the dead
+// ones: their users are un-assigned and reported offline.
+func WithNodeRegistry(r db.Registry, ttl time.Duration) Opt {
+	return func(s *Server) error {
+		if ttl <= 0 {
+			return errors.New("node registry: ttl must be positive")
+		}
+		s.registry = r
+		s.heartbeatTTL = ttl
+		return nil
+	}
+}
+
+// runRegistry registers the server, then refreshes its heartbeat and reaps the dead
+// servers until stop is closed.
+func (s *Server) runRegistry(stop chan struct{}) {
+	s.heartbeat()
+	heartbeat := time.NewTicker(s.heartbeatTTL / 3)
+	defer heartbeat.Stop()
+	reaper := time.NewTicker(s.heartbeatTTL)
+	defer reaper.Stop()
+
+	for {
+		select {
+		case <-heartbeat.C:
+			s.heartbeat()
+		case <-reaper.C:
+			s.reapDeadNodes()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// heartbeat refreshes the heartbeat of the server.
+func (s *Server) heartbeat() {
+	ctx, cancel := s.backgroundContext()
+	defer cancel()
+
+	err := s.registry.RegisterNode(ctx, s.httpAddr, s.heartbeatTTL)
+	if err != nil {
+		log.Error(errors.Wrap(err, "registry: heartbeat"))
+	}
+}
+
+// reapDeadNodes un-assigns the users of the dead servers.
+func (s *Server) reapDeadNodes() {
+	ctx, cancel := s.backgroundContext()
+	nodes, err := s.registry.DeadNodes(ctx)
+	cancel()
+	if err != nil {
+		log.Error(errors.Wrap(err, "registry: dead nodes"))
+		return
+	}
+	for _, node := range nodes {
+		if node == s.httpAddr {
+			// this server missed its own heartbeat, it is still alive
+			s.heartbeat()
+			continue
+		}
+		s.purgeNode(node)
+	}
+}
+
+// purgeNode un-registers a server, reports its users offline and drops the
+// presence subscriptions of their sessions.
+func (s *Server) purgeNode(node string) {
+	ctx, cancel := s.backgroundContext()
+	nicknames, err := s.registry.PurgeNode(ctx, node)
+	cancel()
+	if err != nil {
+		log.Error(errors.Wrapf(err, "registry: purge \"%s\"", node))
+		return
+	}
+	log.Infof("node \"%s\" is dead, %d users un-assigned", node, len(nicknames))
+	if t, ok := s.transport.(PooledTransport); ok {
+		t.ForgetPeer(node)
+	}
+	for _, nickname := range nicknames {
+		ctx, cancel := s.backgroundContext()
+		s.unwatchAll(ctx, nickname)
+		s.trackPresence(ctx, nickname, PresenceOffline)
+		cancel()
+	}
+}
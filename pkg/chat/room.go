@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"context"
+
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrRoomNotFound is returned when the room does not exist.
+	ErrRoomNotFound = errors.New("room not found")
+	// ErrRoomExists is returned when creating a room that already exists.
+	ErrRoomExists = errors.New("room already exists")
+	// ErrNotRoomMember is returned when a user sends a message to a room he has not joined.
+	ErrNotRoomMember = errors.New("not a member of the room")
+	// ErrInvalidRoomName is returned when the room name does not respect the rules.
+	ErrInvalidRoomName = errors.New("invalid room name")
+)
+
+// ValidateRoomName checks that a name can be used for a room.
+// Rooms follow the same rules as nicknames.
+func ValidateRoomName(room string) error {
+	err := validateName(room)
+	if err != nil {
+		return errors.Wrap(ErrInvalidRoomName, err.Error())
+	}
+	return nil
+}
+
+// CreateRoom creates a new empty room.
+func (s *Server) CreateRoom(ctx context.Context, room string) error {
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	err := ValidateRoomName(room)
+	if err != nil {
+		return err
+	}
+	err = s.db.CreateRoom(ctx, room)
+	if err != nil {
+		if err == db.ErrAlreadyExists {
+			return ErrRoomExists
+		}
+		return errors.Wrap(err, "db")
+	}
+	log.Infof("room \"%s\" created", room)
+	return nil
+}
+
+// JoinRoom adds a user to a room.
+func (s *Server) JoinRoom(ctx context.Context, room, nickname string) error {
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	err := s.db.JoinRoom(ctx, room, nickname)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return ErrRoomNotFound
+		}
+		return errors.Wrap(err, "db")
+	}
+	return nil
+}
+
+// LeaveRoom removes a user from a room.
+func (s *Server) LeaveRoom(ctx context.Context, room, nickname string) error {
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	err := s.db.LeaveRoom(ctx, room, nickname)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return ErrRoomNotFound
+		}
+		return errors.Wrap(err, "db")
+	}
+	return nil
+}
+
+// RoomMembers returns the nicknames of the members of a room.
+func (s *Server) RoomMembers(ctx context.Context, room string) ([]string, error) {
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	members, err := s.db.GetRoomMembers(ctx, room)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return nil, ErrRoomNotFound
+		}
+		return nil, errors.Wrap(err, "db")
+	}
+	return members, nil
+}
+
+// SendToRoom sends a message to all members of the room m.Room. The sender only
+// receives it on its other sessions than m.Stream.
+// Members that are not connected are skipped.
+func (s *Server) SendToRoom(ctx context.Context, m *MessagePayload) error {
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	members, err := s.RoomMembers(ctx, m.Room)
+	if err != nil {
+		return err
+	}
+
+	recipients := make([]string, 0, len(members))
+	isMember := false
+	for _, member := range members {
+		if member == m.From {
+			isMember = true
+			if m.Stream == "" {
+				continue
+			}
+		}
+		recipients = append(recipients, member)
+	}
+	if !isMember {
+		return ErrNotRoomMember
+	}
+
+	if m.ID == "" {
+		m.ID, err = newMessageID()
+		if err != nil {
+			return err
+		}
+	}
+	err = s.fanOut(ctx, m, recipients)
+	if err != nil {
+		return err
+	}
+	s.record(ctx, m)
+	return nil
+}
+
+// leaveRooms removes the user of a session from all the rooms joined during the session.
+func (s *Server) leaveRooms(ctx context.Context, sess *Session) {
+	for _, room := range sess.joinedRooms() {
+		err := s.db.LeaveRoom(ctx, room, sess.Nickname)
+		if err != nil && err != db.ErrNotFound {
+			log.Error(errors.Wrapf(err, "leave room \"%s\"", room))
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package chat
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// WithReorderWindow sets how out-of-sequence messages are handled by the receiver:
+// at most size messages per sender are held back, during at most timeout, waiting
+// for the missing ones. Past these limits, held messages are delivered anyway and
+// the client can detect the gap with the sequence numbers.
+func WithReorderWindow(size int, timeout time.Duration) Opt {
+	return func(s *Server) error {
+		if size <= 0 || timeout <= 0 {
+			return errors.New("reorder window: size and timeout must be positive")
+		}
+		s.reorderSize = size
+		s.reorderTimeout = timeout
+		return nil
+	}
+}
+
+// reorderIdleTimeout is the time after which the stream of a sender which has no held
+// message is forgotten, once another stream starts.
+const reorderIdleTimeout = 5 * time.Minute
+
+// reorderBuffer puts the sequenced messages received by a session back in order.
+// Not thread-safe: it is only used by the reader of the session.
+type reorderBuffer struct {
+	size    int
+	timeout time.Duration
+	// streams by sender and session of the sender, see streamKey
+	streams map[string]*stream
+}
+
+// stream is the sequence of messages received from a session of a sender.
+type stream struct {
+	from string
+	// when the last message has been received
+	seen time.Time
+	// next sequence number to deliver
+	expected uint64
+	// messages received ahead of expected, by sequence number
+	held map[uint64]*MessagePayload
+	// when the oldest held message has been received
+	since time.Time
+}
+
+func newReorderBuffer(size int, timeout time.Duration) *reorderBuffer {
+	return &reorderBuffer{
+		size:    size,
+		timeout: timeout,
+		streams: make(map[string]*stream),
+	}
+}
+
+// push adds a received message and returns the messages that can be delivered, in order.
+func (b *reorderBuffer) push(m *MessagePayload) []*MessagePayload {
+	if m.Seq == 0 {
+		return []*MessagePayload{m}
+	}
+
+	key := streamKey(m)
+	st := b.streams[key]
+	// a new stream starts with the first message received from a session of the sender
+	if st == nil {
+		b.prune()
+		st = &stream{
+			from:     m.From,
+			expected: m.Seq,
+			held:     make(map[uint64]*MessagePayload),
+		}
+		b.streams[key] = st
+	}
+	st.seen = time.Now()
+
+	switch {
+	case m.Seq < st.expected:
+		// too late: the gap has already been skipped
+		return []*MessagePayload{m}
+	case m.Seq > st.expected:
+		if len(st.held) == 0 {
+			st.since = time.Now()
+		}
+		st.held[m.Seq] = m
+		if len(st.held) < b.size {
+			return nil
+		}
+		log.Debugf("reorder window of \"%s\" full, skip missing messages", m.From)
+		return st.skip()
+	}
+
+	ready := []*MessagePayload{m}
+	st.expected++
+	return append(ready, st.release()...)
+}
+
+// streamKey returns the key of the stream of a message: the sessions of a sender
+// send concurrent streams.
+func streamKey(m *MessagePayload) string {
+	return m.From + "\x00" + m.Stream
+}
+
+// prune forgets the streams which have no held message and have been idle for
+// reorderIdleTimeout.
+func (b *reorderBuffer) prune() {
+	now := time.Now()
+	for key, st := range b.streams {
+		if len(st.held) == 0 && now.Sub(st.seen) >= reorderIdleTimeout {
+			delete(b.streams, key)
+		}
+	}
+}
+
+// release returns the held messages that directly follow the expected sequence number.
+func (st *stream) release() []*MessagePayload {
+	var ready []*MessagePayload
+	for {
+		m, ok := st.held[st.expected]
+		if !ok {
+			break
+		}
+		delete(st.held, st.expected)
+		ready = append(ready, m)
+		st.expected++
+	}
+	if len(st.held) > 0 {
+		st.since = time.Now()
+	}
+	return ready
+}
+
+// skip gives up on the missing messages and returns all the held ones, in order.
+func (st *stream) skip() []*MessagePayload {
+	seqs := make([]uint64, 0, len(st.held))
+	for seq := range st.held {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	ready := make([]*MessagePayload, 0, len(seqs))
+	for _, seq := range seqs {
+		ready = append(ready, st.held[seq])
+		delete(st.held, seq)
+	}
+	st.expected = seqs[len(seqs)-1] + 1
+	return ready
+}
+
+// deadline returns a channel that fires when the oldest held message times out,
+// or nil if no message is held.
+func (b *reorderBuffer) deadline() <-chan time.Time {
+	var oldest time.Time
+	for _, st := range b.streams {
+		if len(st.held) > 0 && (oldest.IsZero() || st.since.Before(oldest)) {
+			oldest = st.since
+		}
+	}
+	if oldest.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(oldest.Add(b.timeout)))
+}
+
+// expire returns the held messages of the streams that timed out.
+func (b *reorderBuffer) expire() []*MessagePayload {
+	var ready []*MessagePayload
+	now := time.Now()
+	for _, st := range b.streams {
+		if len(st.held) > 0 && now.Sub(st.since) >= b.timeout {
+			log.Debugf("missing messages of \"%s\" timed out", st.from)
+			ready = append(ready, st.skip()...)
+		}
+	}
+	return ready
+}
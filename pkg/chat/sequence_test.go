@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seqMessage returns a message of a stream of a sender.
+func seqMessage(from, stream string, seq uint64) *MessagePayload {
+	return &MessagePayload{From: from, Stream: stream, Seq: seq}
+}
+
+// seqs formats the messages as from/stream/seq.
+func seqs(msgs []*MessagePayload) string {
+	s := make([]string, len(msgs))
+	for i, m := range msgs {
+		s[i] = fmt.Sprintf("%s/%s/%d", m.From, m.Stream, m.Seq)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestReorderBuffer(t *testing.T) {
+	type push struct {
+		m     *MessagePayload
+		ready string
+	}
+	tests := []struct {
+		name   string
+		size   int
+		pushes []push
+	}{
+		{"in order", 4, []push{
+			{seqMessage("alice", "s1", 1), "alice/s1/1"},
+			{seqMessage("alice", "s1", 2), "alice/s1/2"},
+		}},
+		{"not sequenced", 4, []push{
+			{seqMessage("alice", "s1", 1), "alice/s1/1"},
+			{seqMessage("alice", "s1", 3), ""},
+			{seqMessage("alice", "", 0), "alice//0"},
+		}},
+		{"starts at the first received", 4, []push{
+			{seqMessage("alice", "s1", 7), "alice/s1/7"},
+			{seqMessage("alice", "s1", 8), "alice/s1/8"},
+		}},
+		{"out of order", 4, []push{
+			{seqMessage("alice", "s1", 1), "alice/s1/1"},
+			{seqMessage("alice", "s1", 4), ""},
+			{seqMessage("alice", "s1", 3), ""},
+			{seqMessage("alice", "s1", 2), "alice/s1/2,alice/s1/3,alice/s1/4"},
+		}},
+		{"streams of each session and sender", 4, []push{
+			{seqMessage("alice", "s1", 1), "alice/s1/1"},
+			{seqMessage("alice", "s2", 1), "alice/s2/1"},
+			{seqMessage("bob", "s1", 1), "bob/s1/1"},
+			{seqMessage("alice", "s1", 3), ""},
+			// the gap of alice/s1 holds back neither her other session nor bob
+			{seqMessage("alice", "s2", 2), "alice/s2/2"},
+			{seqMessage("bob", "s1", 2), "bob/s1/2"},
+			{seqMessage("alice", "s1", 2), "alice/s1/2,alice/s1/3"},
+		}},
+		{"duplicate held", 4, []push{
+			{seqMessage("alice", "s1", 1), "alice/s1/1"},
+			{seqMessage("alice", "s1", 3), ""},
+			{seqMessage("alice", "s1", 3), ""},
+			{seqMessage("alice", "s1", 2), "alice/s1/2,alice/s1/3"},
+		}},
+		{"window full", 3, []push{
+			{seqMessage("alice", "s1", 1), "alice/s1/1"},
+			{seqMessage("alice", "s1", 3), ""},
+			{seqMessage("alice", "s1", 5), ""},
+			{seqMessage("alice", "s1", 6), "alice/s1/3,alice/s1/5,alice/s1/6"},
+			// the skipped messages are delivered when they arrive late
+			{seqMessage("alice", "s1", 2), "alice/s1/2"},
+			{seqMessage("alice", "s1", 7), "alice/s1/7"},
+		}},
+	}
+	for _, test := range tests {
+		b := newReorderBuffer(test.size, time.Minute)
+		for i, p := range test.pushes {
+			if got := seqs(b.push(p.m)); got != p.ready {
+				t.Errorf("%s: push %d: expected \"%s\", got \"%s\"", test.name, i, p.ready, got)
+			}
+		}
+	}
+}
+
+func TestReorderBufferTimeout(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	b := newReorderBuffer(10, timeout)
+	if b.deadline() != nil {
+		t.Error("deadline without held message")
+	}
+	b.push(seqMessage("alice", "s1", 1))
+	b.push(seqMessage("alice", "s1", 3))
+	b.push(seqMessage("alice", "s1", 4))
+	b.push(seqMessage("bob", "s1", 1))
+	if got := seqs(b.expire()); got != "" {
+		t.Errorf("expired before the timeout: \"%s\"", got)
+	}
+
+	deadline := b.deadline()
+	if deadline == nil {
+		t.Fatal("no deadline with held messages")
+	}
+	select {
+	case <-deadline:
+	case <-time.After(10 * timeout):
+		t.Fatal("deadline not reached")
+	}
+	if got := seqs(b.expire()); got != "alice/s1/3,alice/s1/4" {
+		t.Errorf("unexpected expired messages \"%s\"", got)
+	}
+	if b.deadline() != nil {
+		t.Error("deadline once the held messages expired")
+	}
+	// the stream goes on after the gap
+	if got := seqs(b.push(seqMessage("alice", "s1", 5))); got != "alice/s1/5" {
+		t.Errorf("unexpected messages after the gap \"%s\"", got)
+	}
+}
@@ -1,14 +1,12 @@
 package chat
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dustinkirkland/golang-petname"
 	"github.com/nouney/fluxracine/internal/db"
@@ -26,22 +24,88 @@ var (
 type Server struct {
 	// db used by the server
 	db db.DB
-	// address of form "ip:port" of the internal http server
-	httpAddr string
-	httpSrv  http.Server
-	sessions map[string]*Session
+	// bounds the calls to the db which are not bound to a request
+	dbTimeout time.Duration
+	// cancelled by GracefulShutdown, to interrupt the in-flight calls to the db
+	ctx    context.Context
+	cancel context.CancelFunc
+	// storage of the messages, can be nil
+	history db.History
+	// storage of the messages sent to offline users, can be nil
+	inbox    db.Inbox
+	inboxTTL time.Duration
+	// storage of the presence of the users, can be nil
+	presence db.Presence
+	// authenticator of the users, can be nil
+	auth Authenticator
+	// address of form "ip:port" on which the transport listens, it identifies
+	// the server in the cluster
+	httpAddr  string
+	transport Transport
+	// security of the communications between the servers, can be nil
+	clusterTLS    *tls.Config
+	clusterSigner *ClusterSigner
+	// policy of the forwarding to the other servers
+	forwardPolicy ForwardPolicy
+	breakers      *breakers
+	// deliveries received from the other servers
+	dedup *dedup
+	// token protecting the admin endpoints, they are disabled if empty
+	adminToken string
+	version    string
+	startedAt  time.Time
+	// registry of the servers of the cluster, can be nil
+	registry     db.Registry
+	heartbeatTTL time.Duration
+	// closed to stop the heartbeat of the server
+	stopRegistry chan struct{}
+
+	// sessions connected on this server, by nickname and ID
+	sessions map[string]map[string]*Session
 	mutex    *sync.Mutex
+	// set when the server does not accept new sessions anymore
+	draining bool
 	// Fake session of user "SYSTEM"
 	systemSess *Session
+	// timers expiring the typing signals, by sender and receiver
+	typingTimers  map[string]*time.Timer
+	typingTimeout time.Duration
+	typingMutex   sync.Mutex
+	// bounds of the reordering of the received messages
+	reorderSize    int
+	reorderTimeout time.Duration
+	// configuration of the outbox of the sessions
+	outboxCapacity int
+	outboxPolicy   OverflowPolicy
+	// number of messages dropped by all the outboxes, updated atomically
+	dropped *uint64
 }
 
 // NewServer creates a new Server object.
 func NewServer(db db.DB, opts ...Opt) (*Server, error) {
 	s := &Server{
-		db:       db,
-		sessions: make(map[string]*Session),
-		httpAddr: "localhost:8000",
-		mutex:    new(sync.Mutex),
+		db:        db,
+		dbTimeout: 5 * time.Second,
+		sessions:  make(map[string]map[string]*Session),
+		httpAddr:  "localhost:8000",
+		mutex:     new(sync.Mutex),
+
+		version:   "dev",
+		startedAt: time.Now(),
+
+		forwardPolicy: DefaultForwardPolicy,
+		breakers:      newBreakers(),
+		dedup:         newDedup(),
+
+		typingTimers:  make(map[string]*time.Timer),
+		typingTimeout: 5 * time.Second,
+
+		reorderSize:    32,
+		reorderTimeout: time.Second,
+
+		outboxCapacity: 256,
+		outboxPolicy:   DropOldest,
+		dropped:        new(uint64),
 	}
 
 	for _, opt := range opts {
@@ -50,6 +114,19 @@ func NewServer(db db.DB, opts ...Opt) (*Server, error) {
 			return nil, err
 		}
 	}
+	if s.transport == nil {
+		s.transport = NewHTTPTransport()
+	}
+	err := s.secureTransport()
+	if err != nil {
+		return nil, err
+	}
+	err = s.serveAdmin()
+	if err != nil {
+		return nil, err
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
 	// session used by the server to send messages as "SYSTEM"
 	s.systemSess = &Session{
@@ -59,130 +136,348 @@ func NewServer(db db.DB, opts ...Opt) (*Server, error) {
 	return s, nil
 }
 
-// NewSession creates a new session bound to this Server
-func (s *Server) NewSession() (*Session, error) {
+// NewSession creates a new session bound to this Server.
+// If nickname is empty, a random one is generated. Otherwise it is validated and
+// registered across the cluster: ErrInvalidNickname or ErrNicknameTaken are returned
+// (possibly wrapped, use errors.Cause) if it cannot be used.
+// With an authenticator, a user can have several sessions, possibly on different servers.
+// Without it, nothing proves that two sessions belong to the same user, so a nickname
+// is used by a single session.
+// The user is not reported online until the presence of the session is set, once
+// the client is ready (e.g. on event.EventUserLogin).
+// Returns ErrDraining if the server is being drained.
+func (s *Server) NewSession(ctx context.Context, nickname string) (*Session, error) {
+	if s.Draining() {
+		return nil, ErrDraining
+	}
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	id, err := newMessageID()
+	if err != nil {
+		return nil, err
+	}
 	sess := &Session{
-		server: s,
-		recv:   make(chan *MessagePayload, 10),
+		ID:        id,
+		server:    s,
+		seqs:      make(map[string]uint64),
+		outbox:    newOutbox(s.outboxCapacity, s.outboxPolicy, s.dropped),
+		rooms:     make(map[string]bool),
+		reorder:   newReorderBuffer(s.reorderSize, s.reorderTimeout),
+		delivered: newDeliveredSet(deliveredSetSize),
+
+		connectedAt: time.Now(),
 	}
 
-	// generate a random nickname and assign the server address to the user
-	nickname := petname.Generate(2, "-")
-	err := s.db.AssignServer(nickname, s.httpAddr)
+	if nickname == "" {
+		nickname, err = s.addRandomSession(ctx, id)
+	} else {
+		err = s.addSession(ctx, nickname, id, s.auth == nil)
+	}
 	if err != nil {
-		// check if dup
-		// if dup: retry with another name
 		return nil, err
 	}
 	sess.Nickname = nickname
+	s.markKnown(ctx, nickname)
 	s.mutex.Lock()
-	s.sessions[nickname] = sess
+	if s.sessions[nickname] == nil {
+		s.sessions[nickname] = make(map[string]*Session)
+	}
+	s.sessions[nickname][id] = sess
 	s.mutex.Unlock()
+	// drained once the session is registered, so that no message is queued after
+	s.drainInbox(ctx, sess)
 
-	// greets the user and send its nickname
-	err = s.systemSess.SendMessage(nickname, fmt.Sprintf("Greetings, %s.", nickname))
+	// greets the user and send its nickname, to this session only
+	greetingID, err := newMessageID()
 	if err != nil {
-		return nil, errors.Wrap(err, "send to user")
+		return nil, err
 	}
+	sess.outbox.push(&MessagePayload{
+		ID:      greetingID,
+		From:    s.systemSess.Nickname,
+		To:      nickname,
+		Message: fmt.Sprintf("Greetings, %s.", nickname),
+	}, false)
 	return sess, nil
 }
 
 // CloseSession closes a session.
-// It removes the user from the entire system.
-func (s *Server) CloseSession(nickname string) error {
+// The other sessions of the user are left alone: the user is removed from the entire
+// system when its last session is closed. Until then, the rooms joined by the session
+// are handed over to another session of the user on this server, and the presence
+// subscriptions, which belong to the user, are kept.
+// If the remaining sessions are all on other servers, they are kept until the user
+// leaves them explicitly.
+func (s *Server) CloseSession(ctx context.Context, sess *Session) error {
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	nickname := sess.Nickname
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	sess := s.sessions[nickname]
-	if sess != nil {
-		close(sess.recv)
+	_, ok := s.sessions[nickname][sess.ID]
+	delete(s.sessions[nickname], sess.ID)
+	if len(s.sessions[nickname]) == 0 {
+		delete(s.sessions, nickname)
 	}
-	delete(s.sessions, nickname)
+	s.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	sess.outbox.close()
+	s.markKnown(ctx, nickname)
 
-	err := s.db.UnassignServer(nickname)
+	err := s.db.RemoveSession(ctx, nickname, db.Endpoint{Server: s.httpAddr, Session: sess.ID})
 	if err != nil {
 		return errors.Wrap(err, "db")
 	}
+	_, err = s.db.GetSessions(ctx, nickname)
+	if err == nil {
+		if other := s.localSession(nickname); other != nil {
+			other.adopt(sess)
+		}
+		log.Infof("session \"%s\" of user \"%s\" closed, other sessions remain", sess.ID, nickname)
+		return nil
+	}
+	if err != db.ErrNotFound {
+		return errors.Wrap(err, "db")
+	}
+
+	s.leaveRooms(ctx, sess)
+	s.unwatchAll(ctx, nickname)
+	s.stopTyping(ctx, nickname)
+	s.trackPresence(ctx, nickname, PresenceOffline)
 	log.Infof("session of user \"%s\" closed", nickname)
 	return nil
 }
 
 // CloseAllSessions closes all sessions on this server.
 func (s *Server) CloseAllSessions() {
+	for _, sess := range s.localSessions() {
+		ctx, cancel := s.backgroundContext()
+		err := s.CloseSession(ctx, sess)
+		cancel()
+		if err != nil {
+			log.Error(errors.Wrapf(err, "close session of \"%s\"", sess.Nickname))
+		}
+	}
+}
+
+// localSession returns any session of a user connected on this server, or nil.
+func (s *Server) localSession(nickname string) *Session {
 	s.mutex.Lock()
-	defer s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, sess := range s.sessions[nickname] {
+		return sess
+	}
+	return nil
+}
 
-	for nickname, sess := range s.sessions {
-		s.db.UnassignServer(nickname)
+// localSessions returns all the sessions connected on this server.
+func (s *Server) localSessions() []*Session {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-		if sess != nil {
-			close(sess.recv)
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, byID := range s.sessions {
+		for _, sess := range byID {
+			sessions = append(sessions, sess)
 		}
-		delete(s.sessions, nickname)
 	}
+	return sessions
 }
 
 // MessagePayload represents a message
 type MessagePayload struct {
-	From    string
-	To      string
+	// ID is assigned by the server when the message is sent
+	ID string
+	// Seq is the sequence number of the message in the conversation between the
+	// session Stream of From and To, starting at 1. Zero if the message is not sequenced.
+	Seq    uint64 `json:",omitempty"`
+	Stream string `json:",omitempty"`
+	From   string
+	To     string
+	// Room is set if the message has been sent to a room
+	Room    string
 	Message string
+	// Presence is set if the message is a presence notification instead of a text message
+	Presence *PresenceUpdate `json:",omitempty"`
+	// Receipt is set if the message is a receipt instead of a text message
+	Receipt *Receipt `json:",omitempty"`
+	// Signal is set if the message is an ephemeral signal instead of a text message
+	Signal *Signal `json:",omitempty"`
+	// Reconnect is set if the message asks the user to reconnect to another server
+	Reconnect *Reconnect `json:",omitempty"`
 }
 
 // Send sends a message from a user to another one.
-// If the receiver is not connected on this server, the message will be forwarded
-// to the appropriate server.
-func (s *Server) Send(m *MessagePayload) error {
-	err := s.sendToUser(m)
-	if err == nil {
-		return nil
+// The message is sent to all the sessions of the receiver, and echoed to the other
+// sessions of the sender. It is forwarded to the appropriate servers.
+// An ID is assigned to the message if it does not have one.
+// If the message cannot be forwarded, the cause of the returned error is one of
+// ErrPeerUnreachable, ErrPeerTimeout, ErrPeerUnavailable, ErrPeerRejected or ErrCircuitOpen.
+func (s *Server) Send(ctx context.Context, m *MessagePayload) error {
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	if m.ID == "" {
+		id, err := newMessageID()
+		if err != nil {
+			return err
+		}
+		m.ID = id
 	}
-	if err != ErrUserNotFound {
-		return errors.Wrap(err, "send to user")
+
+	err := s.deliver(ctx, m)
+	if err != nil {
+		return err
 	}
+	s.record(ctx, m)
+	if m.Stream != "" && m.To != m.From {
+		s.echo(ctx, m)
+	}
+	return nil
+}
 
-	err = s.forwardMessage(m)
+// deliver sends a message to all the sessions of its receiver, locally or by forwarding it.
+// Returns ErrUserNotFound if the receiver has no session, unless the message has been
+// queued in the offline inbox.
+func (s *Server) deliver(ctx context.Context, m *MessagePayload) error {
+	servers, err := s.serversOf(ctx, m.To)
+	if err == ErrUserNotFound {
+		return s.userNotFound(ctx, m)
+	}
 	if err != nil {
-		if err == ErrUserNotFound {
-			return err
+		return err
+	}
+
+	err = s.deliverToServers(ctx, m.To, m, servers)
+	if err != nil && s.invalidateSessions(m.To) {
+		// the cached sessions may be stale, retry with the current ones
+		current, dbErr := s.serversOf(ctx, m.To)
+		if dbErr == ErrUserNotFound {
+			err = ErrUserNotFound
+		} else if dbErr == nil {
+			moved := difference(current, servers)
+			if len(moved) > 0 {
+				log.Debugf("user \"%s\" moved, deliver message to %v", m.To, moved)
+				err = s.deliverToServers(ctx, m.To, m, moved)
+			}
 		}
-		return errors.Wrap(err, "forward")
 	}
-	return nil
+	if err == ErrUserNotFound {
+		return s.userNotFound(ctx, m)
+	}
+	return err
 }
 
-// Receive waits until a message is received by user nickname.
-// Thread safe.
-func (s *Server) Receive(nickname string) (*MessagePayload, error) {
+// echo sends a copy of a message to the other sessions of its sender, so that all
+// the devices of the user show the conversation. The echo is not sequenced.
+func (s *Server) echo(ctx context.Context, m *MessagePayload) {
+	endpoints, err := s.db.GetSessions(ctx, m.From)
+	if err != nil {
+		if err != db.ErrNotFound {
+			log.Error(errors.Wrap(err, "echo: db"))
+		}
+		return
+	}
+	others := make([]db.Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if e.Session != m.Stream {
+			others = append(others, e)
+		}
+	}
+	if len(others) == 0 {
+		return
+	}
+
+	cpy := *m
+	cpy.Seq = 0
+	err = s.deliverToServers(ctx, m.From, &cpy, db.Servers(others))
+	if err != nil && err != ErrUserNotFound {
+		log.Error(errors.Wrapf(err, "echo to \"%s\"", m.From))
+	}
+}
+
+// deliverToServers sends a message to the sessions of user nickname connected on some servers.
+// It succeeds if at least one server delivered the message, otherwise the first error
+// is returned, ErrUserNotFound if the user is not connected on any of them.
+func (s *Server) deliverToServers(ctx context.Context, nickname string, m *MessagePayload, servers []string) error {
+	var firstErr error
+	delivered := false
+	for _, server := range servers {
+		var err error
+		if server == s.httpAddr {
+			err = s.sendToUser(nickname, m)
+		} else {
+			log.Debugf("forward message to \"%s\"", server)
+			err = s.forward(ctx, server, m, []string{nickname})
+			if err != nil && err != ErrUserNotFound {
+				err = errors.Wrap(err, "forward")
+			}
+		}
+		if err == nil {
+			delivered = true
+			continue
+		}
+		if err != ErrUserNotFound && len(servers) > 1 {
+			log.Warn(errors.Wrapf(err, "deliver to \"%s\"", server))
+		}
+		if firstErr == nil || firstErr == ErrUserNotFound {
+			firstErr = err
+		}
+	}
+	if delivered {
+		return nil
+	}
+	return firstErr
+}
+
+// serversOf returns the servers on which a user has sessions.
+// Returns ErrUserNotFound if the user has no session.
+func (s *Server) serversOf(ctx context.Context, nickname string) ([]string, error) {
+	endpoints, err := s.db.GetSessions(ctx, nickname)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return nil, ErrUserNotFound
+		}
+		return nil, errors.Wrap(err, "db")
+	}
+	return db.Servers(endpoints), nil
+}
+
+// Receive waits until a message is received by the session id of user nickname.
+// Thread safe, but the messages of a session must be read by a single goroutine.
+func (s *Server) Receive(nickname, id string) (*MessagePayload, error) {
 	s.mutex.Lock()
-	sess, ok := s.sessions[nickname]
+	sess, ok := s.sessions[nickname][id]
 	s.mutex.Unlock()
 	if !ok {
 		return nil, ErrUserNotFound
 	}
-	m, ok := <-sess.recv
-	if !ok {
-		return nil, io.EOF
-	}
-	return m, nil
+	return sess.ReceiveMessage()
 }
 
 // Run runs the server.
-// At this time, it just runs the internal HTTP server in background.
+// At this time, it just runs the transport and the heartbeat in background.
 func (s *Server) Run() {
 	go func() {
-		mux := http.NewServeMux()
-		mux.HandleFunc("/send", s.sendHandler)
-
-		s.httpSrv.Addr = s.httpAddr
-		s.httpSrv.Handler = mux
-
-		log.Infof("start cluster http server on address \"%s\"", s.httpAddr)
-		err := s.httpSrv.ListenAndServe()
+		err := s.transport.Listen(s.httpAddr, s.deliverFromPeer)
 		if err != nil {
-			log.Error(errors.Wrap(err, "http"))
+			log.Error(errors.Wrap(err, "transport"))
 		}
 	}()
+	if s.registry != nil {
+		s.stopRegistry = make(chan struct{})
+		go s.runRegistry(s.stopRegistry)
+	}
+}
+
+// DroppedMessages returns the number of messages dropped by the outboxes of
+// the sessions of this server.
+func (s *Server) DroppedMessages() uint64 {
+	return atomic.LoadUint64(s.dropped)
 }
 
 // NbSessions returns the number of session on the server.
@@ -190,88 +485,126 @@ func (s *Server) NbSessions() int {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	return len(s.sessions)
+	n := 0
+	for _, byID := range s.sessions {
+		n += len(byID)
+	}
+	return n
 }
 
 // GracefulShutdown gracefuly shutdowns the current server.
-// It will remove all users from redis and clear its sessions.
-// The object can be reused later.
+// It interrupts the in-flight calls to the db, then removes all users from the db
+// and clears its sessions. The server stays draining: new sessions are refused.
 func (s *Server) GracefulShutdown() {
-	s.CloseAllSessions()
-	s.httpSrv.Shutdown(context.Background())
-}
-
-// sendToUser send a message to a user connected on this server, using its channel.
-// Returns ErrUserNotFound if the user is not connected on this server.
-func (s *Server) sendToUser(m *MessagePayload) error {
+	if s.stopRegistry != nil {
+		close(s.stopRegistry)
+		s.stopRegistry = nil
+	}
 	s.mutex.Lock()
-	sess := s.sessions[m.To]
+	s.draining = true
+	s.cancel()
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	s.mutex.Unlock()
-	if sess == nil {
-		log.Debugf("user \"%s\" is not connected on this server", m.To)
-		return ErrUserNotFound
+
+	s.CloseAllSessions()
+	if s.registry != nil {
+		err := s.unregister()
+		if err != nil {
+			log.Error(errors.Wrap(err, "registry: unregister"))
+		}
 	}
+	s.transport.Close()
+}
 
-	sess.recv <- m
-	return nil
+// unregister removes this server from the registry, giving up after the db timeout.
+func (s *Server) unregister() error {
+	ctx, cancel := s.backgroundContext()
+	defer cancel()
+
+	_, err := s.registry.PurgeNode(ctx, s.httpAddr)
+	return err
 }
 
-// sendHandler is the HTTP handler used when another server needs this server to send a message
-// to a user (forwarding).
-func (s *Server) sendHandler(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+// addSession validates a nickname and registers the session id of this server for it.
+// If exclusive, fails with ErrNicknameTaken if the nickname is already used on the cluster.
+func (s *Server) addSession(ctx context.Context, nickname, id string, exclusive bool) error {
+	err := ValidateNickname(nickname)
 	if err != nil {
-		log.Error(errors.Wrap(err, "read all"))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return err
 	}
-
-	m := MessagePayload{}
-	err = json.Unmarshal(body, &m)
+	err = s.db.AddSession(ctx, nickname, db.Endpoint{Server: s.httpAddr, Session: id}, exclusive)
 	if err != nil {
-		log.Error(errors.Wrap(err, "unmarshal json:"))
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	log.Infof("message to forward: %+v", &m)
-	err = s.sendToUser(&m)
-	if err == ErrUserNotFound {
-		w.WriteHeader(http.StatusNotFound)
+		if err == db.ErrAlreadyExists {
+			return ErrNicknameTaken
+		}
+		return errors.Wrap(err, "db")
 	}
+	return nil
 }
 
-// forwardMessage forwards a message to the appropriate server so it can be sent to the user.
-// Returns ErrUserNotFound if no server is associated to the receiver or if the user doesn't
-// exist on the server.
-func (s *Server) forwardMessage(m *MessagePayload) error {
-	// retrieve the server on which the receiver is connected
-	server, err := s.db.GetServer(m.To)
-	if err != nil {
-		if err == db.ErrNotFound {
-			s.systemSess.SendMessage(m.From, fmt.Sprintf("user \"%s\": not found", m.To))
-			return ErrUserNotFound
+// addRandomSession generates random nicknames until a free one is found
+// and registers the session id of this server for it.
+func (s *Server) addRandomSession(ctx context.Context, id string) (string, error) {
+	for {
+		nickname := petname.Generate(2, "-")
+		err := s.addSession(ctx, nickname, id, true)
+		if err == nil {
+			return nickname, nil
 		}
-		return err
-	}
-
-	log.Debugf("forward message to \"%s\"", server)
-
-	b, err := json.Marshal(m)
-	if err != nil {
-		return errors.Wrap(err, "json marshal")
+		if err != ErrNicknameTaken {
+			return "", err
+		}
+		log.Debugf("random nickname \"%s\" already taken, retry", nickname)
 	}
+}
 
-	resp, err := http.Post("http://"+server+"/send", "application/json", bytes.NewBuffer(b))
-	if err != nil {
-		return errors.Wrap(err, "http post")
+// sendToUser sends a message to the sessions of user nickname connected on this server,
+// using their outbox. The session which sent the message does not receive it back.
+// It never blocks: if an outbox is full, the overflow policy applies.
+// Returns ErrUserNotFound if the user is not connected on this server.
+func (s *Server) sendToUser(nickname string, m *MessagePayload) error {
+	s.mutex.Lock()
+	sessions := make([]*Session, 0, len(s.sessions[nickname]))
+	for _, sess := range s.sessions[nickname] {
+		sessions = append(sessions, sess)
 	}
-	if resp.StatusCode == http.StatusNotFound {
-		s.systemSess.SendMessage(m.From, fmt.Sprintf("user \"%s\": not found", m.To))
+	s.mutex.Unlock()
+	if len(sessions) == 0 {
+		log.Debugf("user \"%s\" is not connected on this server", nickname)
 		return ErrUserNotFound
 	}
-	if resp.StatusCode == http.StatusInternalServerError {
-		return fmt.Errorf("http post bad status code: %d", resp.StatusCode)
+
+	for _, sess := range sessions {
+		if nickname == m.From && nickname != m.To && sess.ID == m.Stream {
+			continue
+		}
+		// each session reads its own copy
+		cpy := *m
+		// signals are lossy: they never evict other messages
+		if !sess.outbox.push(&cpy, m.Signal != nil) {
+			log.Debugf("message to \"%s\" dropped", nickname)
+		}
 	}
 	return nil
 }
+
+// invalidateSessions drops the cached sessions of a user, if the db caches them.
+// Returns true if it does.
+func (s *Server) invalidateSessions(nickname string) bool {
+	inv, ok := s.db.(db.Invalidator)
+	if ok {
+		inv.InvalidateSessions(nickname)
+	}
+	return ok
+}
+
+// userNotFound handles a message whose receiver is not connected: the message is
+// queued if possible, otherwise the sender is notified and ErrUserNotFound is returned.
+func (s *Server) userNotFound(ctx context.Context, m *MessagePayload) error {
+	err := s.storeOffline(ctx, m)
+	if err != ErrUserNotFound {
+		return err
+	}
+	s.systemSess.SendMessage(ctx, m.From, fmt.Sprintf("user \"%s\": not found", m.To))
+	return ErrUserNotFound
+}
@@ -0,0 +1,355 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db/memory"
+	"github.com/pkg/errors"
+)
+
+// testTimeout bounds the wait for a message in the tests
+const testTimeout = 2 * time.Second
+
+// nicknameAuthenticator trusts the nickname given in the "nickname" header, so that
+// a user can have several sessions.
+type nicknameAuthenticator struct{}
+
+func (nicknameAuthenticator) Authenticate(r *http.Request) (string, error) {
+	return r.Header.Get("nickname"), nil
+}
+
+// newTestServer creates a server on the memory backend.
+func newTestServer(t *testing.T, opts ...Opt) *Server {
+	s, err := NewServer(memory.NewDB(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testClient reads the messages of a session in the background, like the websocket
+// handler does.
+type testClient struct {
+	t    *testing.T
+	sess *Session
+	msgs chan *MessagePayload
+}
+
+// connect opens a session and reads its messages until it is closed.
+func connect(t *testing.T, s *Server, nickname string) *testClient {
+	sess, err := s.NewSession(context.Background(), nickname)
+	if err != nil {
+		t.Fatalf("new session \"%s\": %v", nickname, err)
+	}
+	c := &testClient{t: t, sess: sess, msgs: make(chan *MessagePayload, 64)}
+	go func() {
+		defer close(c.msgs)
+		for {
+			m, err := sess.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			c.msgs <- m
+		}
+	}()
+	return c
+}
+
+// next returns the next message received from a user, skipping the other ones
+// and the greetings of SYSTEM.
+func (c *testClient) next(from string) *MessagePayload {
+	timer := time.NewTimer(testTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case m, ok := <-c.msgs:
+			if !ok {
+				c.t.Fatalf("\"%s\": session closed while waiting for a message from \"%s\"", c.sess.Nickname, from)
+			}
+			if m.From == from && !isGreeting(m) {
+				return m
+			}
+		case <-timer.C:
+			c.t.Fatalf("\"%s\": no message from \"%s\"", c.sess.Nickname, from)
+		}
+	}
+}
+
+func isGreeting(m *MessagePayload) bool {
+	return m.From == "SYSTEM" && strings.HasPrefix(m.Message, "Greetings, ")
+}
+
+// expectText waits for a text message from a user and checks its content.
+func (c *testClient) expectText(from, text string) *MessagePayload {
+	m := c.next(from)
+	if m.Message != text {
+		c.t.Fatalf("\"%s\": expected \"%s\" from \"%s\", got \"%s\"", c.sess.Nickname, text, from, m.Message)
+	}
+	return m
+}
+
+// expectNothing checks that no message from a user is received for a short while.
+func (c *testClient) expectNothing(from string) {
+	timer := time.NewTimer(100 * time.Millisecond)
+	defer timer.Stop()
+	for {
+		select {
+		case m, ok := <-c.msgs:
+			if ok && m.From == from && !isGreeting(m) {
+				c.t.Fatalf("\"%s\": unexpected message from \"%s\": %+v", c.sess.Nickname, from, m)
+			}
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+func (c *testClient) close() {
+	err := c.sess.Close()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func TestNewSessionNickname(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	alice := connect(t, s, "alice")
+	_, err := s.NewSession(ctx, "alice")
+	if errors.Cause(err) != ErrNicknameTaken {
+		t.Errorf("expected ErrNicknameTaken, got %v", err)
+	}
+	for _, nickname := range []string{"a", "with space", "system"} {
+		_, err = s.NewSession(ctx, nickname)
+		if errors.Cause(err) != ErrInvalidNickname {
+			t.Errorf("\"%s\": expected ErrInvalidNickname, got %v", nickname, err)
+		}
+	}
+
+	random, err := s.NewSession(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateNickname(random.Nickname); err != nil {
+		t.Errorf("random nickname \"%s\": %v", random.Nickname, err)
+	}
+
+	// the nickname is released with the session
+	alice.close()
+	connect(t, s, "alice")
+}
+
+func TestSendMessage(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	alice := connect(t, s, "alice")
+	bob := connect(t, s, "bob")
+
+	for i, text := range []string{"hello", "how are you?"} {
+		id, err := alice.sess.SendMessage(ctx, "bob", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := bob.expectText("alice", text)
+		if m.ID != id || m.To != "bob" {
+			t.Errorf("unexpected message %+v, id \"%s\"", m, id)
+		}
+		if m.Stream != alice.sess.ID || m.Seq != uint64(i+1) {
+			t.Errorf("message %d: unexpected sequence %d of stream \"%s\"", i, m.Seq, m.Stream)
+		}
+
+		err = bob.sess.MessageDelivered(ctx, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := alice.next("SYSTEM")
+		for r.Receipt == nil {
+			r = alice.next("SYSTEM")
+		}
+		if r.Receipt.MessageID != id || r.Receipt.By != "bob" || r.Receipt.Status != ReceiptDelivered {
+			t.Errorf("unexpected receipt %+v", r.Receipt)
+		}
+	}
+
+	// only the messages delivered to the session can be marked as read
+	err := bob.sess.MessageRead(ctx, "alice", "unknown")
+	if errors.Cause(err) != ErrUnknownMessage {
+		t.Errorf("expected ErrUnknownMessage, got %v", err)
+	}
+
+	_, err = alice.sess.SendMessage(ctx, "nobody", "hello?")
+	if errors.Cause(err) != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+	alice.expectText("SYSTEM", "user \"nobody\": not found")
+}
+
+func TestRooms(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	alice := connect(t, s, "alice")
+	bob := connect(t, s, "bob")
+	carol := connect(t, s, "carol")
+
+	err := alice.sess.CreateRoom(ctx, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bob.sess.CreateRoom(ctx, "general")
+	if errors.Cause(err) != ErrRoomExists {
+		t.Errorf("expected ErrRoomExists, got %v", err)
+	}
+	err = bob.sess.JoinRoom(ctx, "missing")
+	if errors.Cause(err) != ErrRoomNotFound {
+		t.Errorf("expected ErrRoomNotFound, got %v", err)
+	}
+	err = bob.sess.JoinRoom(ctx, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := carol.sess.RoomMembers(ctx, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(members)
+	if strings.Join(members, ",") != "alice,bob" {
+		t.Errorf("unexpected members %v", members)
+	}
+
+	err = alice.sess.SendRoomMessage(ctx, "general", "hi all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := bob.expectText("alice", "hi all")
+	if m.Room != "general" {
+		t.Errorf("unexpected room \"%s\"", m.Room)
+	}
+	alice.expectNothing("alice")
+	carol.expectNothing("alice")
+
+	err = carol.sess.SendRoomMessage(ctx, "general", "let me in")
+	if errors.Cause(err) != ErrNotRoomMember {
+		t.Errorf("expected ErrNotRoomMember, got %v", err)
+	}
+
+	// the rooms are left with the last session
+	bob.close()
+	members, err = alice.sess.RoomMembers(ctx, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(members, ",") != "alice" {
+		t.Errorf("unexpected members %v", members)
+	}
+}
+
+func TestOfflineInbox(t *testing.T) {
+	s := newTestServer(t, WithOfflineInbox(memory.NewInbox(), time.Minute))
+	ctx := context.Background()
+	alice := connect(t, s, "alice")
+
+	// bob is unknown until he connects once
+	_, err := alice.sess.SendMessage(ctx, "bob", "are you there?")
+	if errors.Cause(err) != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+	alice.expectText("SYSTEM", "user \"bob\": not found")
+	connect(t, s, "bob").close()
+
+	id, err := alice.sess.SendMessage(ctx, "bob", "see you later")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.expectText("SYSTEM", "user \"bob\" is offline, the message will be delivered later")
+
+	bob := connect(t, s, "bob")
+	m := bob.expectText("alice", "see you later")
+	if m.ID != id || m.Stream != alice.sess.ID || m.Seq != 1 {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	// the inbox is drained
+	bob.close()
+	bob = connect(t, s, "bob")
+	bob.expectNothing("alice")
+}
+
+func TestMultipleSessions(t *testing.T) {
+	s := newTestServer(t, WithAuthenticator(nicknameAuthenticator{}))
+	ctx := context.Background()
+	laptop := connect(t, s, "alice")
+	phone := connect(t, s, "alice")
+	bob := connect(t, s, "bob")
+
+	// the messages are delivered to all the sessions of the receiver
+	_, err := bob.sess.SendMessage(ctx, "alice", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop.expectText("bob", "hello")
+	phone.expectText("bob", "hello")
+
+	// and echoed to the other sessions of the sender
+	_, err = laptop.sess.SendMessage(ctx, "bob", "hi bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.expectText("alice", "hi bob")
+	m := phone.expectText("alice", "hi bob")
+	if m.To != "bob" {
+		t.Errorf("unexpected echo %+v", m)
+	}
+	laptop.expectNothing("alice")
+
+	// the user stays connected until his last session is closed
+	laptop.close()
+	_, err = bob.sess.SendMessage(ctx, "alice", "still there?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone.expectText("bob", "still there?")
+
+	phone.close()
+	_, err = bob.sess.SendMessage(ctx, "alice", "bye")
+	if errors.Cause(err) != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	s := newTestServer(t, WithHistory(memory.NewHistory()))
+	ctx := context.Background()
+	alice := connect(t, s, "alice")
+	bob := connect(t, s, "bob")
+
+	var ids []string
+	for _, text := range []string{"hello", "how are you?"} {
+		id, err := alice.sess.SendMessage(ctx, "bob", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob.expectText("alice", text)
+		ids = append(ids, id)
+	}
+
+	// the messages of the history can be matched with the live ones
+	page, err := bob.sess.History(ctx, "alice", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 {
+		t.Fatalf("unexpected history %v", page)
+	}
+	for i, m := range page {
+		if m.ID != int64(i+1) || m.MessageID != ids[i] || m.Seq != uint64(i+1) || m.Stream != alice.sess.ID {
+			t.Errorf("message %d: unexpected %+v", i, m)
+		}
+	}
+}
@@ -1,36 +1,280 @@
 package chat
 
-import "io"
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+)
 
 // Session is an user chat session.
 // It is created each time a user logs in.
 type Session struct {
+	// ID identifies the session among the ones of the user. It is also the stream
+	// of the messages sent during this session.
+	ID       string
 	Nickname string
 
 	server *Server
-	recv   chan *MessagePayload
+	outbox *outbox
+	// messages to deliver before the ones of the outbox (e.g. from the offline inbox
+	// or released by the reorder buffer)
+	pending []*MessagePayload
+	// puts the messages of the outbox back in order, only used by the reader
+	reorder *reorderBuffer
+	// last sequence numbers of the messages sent during this session, by receiver
+	seqs map[string]uint64
+	// messages delivered during this session, which can be marked as read
+	delivered *deliveredSet
+	// rooms joined during this session
+	rooms map[string]bool
+	// when and from where the user connected
+	connectedAt time.Time
+	remoteAddr  string
+	mutex       sync.Mutex
+}
+
+// SetRemoteAddr sets the network address of the user, shown by the admin endpoints.
+func (s *Session) SetRemoteAddr(addr string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remoteAddr = addr
+}
+
+// info returns the information about the session shown by the admin endpoints.
+func (s *Session) info() *SessionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return &SessionInfo{
+		ID:          s.ID,
+		Nickname:    s.Nickname,
+		RemoteAddr:  s.remoteAddr,
+		ConnectedAt: s.connectedAt,
+	}
 }
 
 // SendMessage sends a message to someone.
-func (s *Session) SendMessage(to, msg string) error {
-	return s.server.Send(&MessagePayload{
+// It returns the ID of the message.
+func (s *Session) SendMessage(ctx context.Context, to, msg string) (string, error) {
+	m := &MessagePayload{
 		From:    s.Nickname,
 		To:      to,
 		Message: msg,
+	}
+	// the SYSTEM session does not sequence its messages
+	if s.ID != "" {
+		m.Stream = s.ID
+		m.Seq = s.nextSeq(to)
+	}
+	err := s.server.Send(ctx, m)
+	if err != nil {
+		// nothing has been delivered when Send fails
+		if m.Seq != 0 {
+			s.releaseSeq(to, m.Seq)
+		}
+		return "", err
+	}
+	return m.ID, nil
+}
+
+// MessageDelivered informs the sender of a received message that it has been delivered.
+// Nothing is sent for the echoes of the messages sent by the user from another session.
+func (s *Session) MessageDelivered(ctx context.Context, m *MessagePayload) error {
+	if m.From == s.Nickname {
+		return nil
+	}
+	if m.ID != "" {
+		s.delivered.add(m.From, m.ID)
+	}
+	return s.server.SendReceipt(ctx, m, ReceiptDelivered)
+}
+
+// MessageRead informs the sender of a message that it has been read.
+// ErrUnknownMessage is returned if the message has not been delivered to this session,
+// or too long ago.
+func (s *Session) MessageRead(ctx context.Context, from, id string) error {
+	if !s.delivered.contains(from, id) {
+		return ErrUnknownMessage
+	}
+	return s.server.SendReceipt(ctx, &MessagePayload{
+		ID:   id,
+		From: from,
+		To:   s.Nickname,
+	}, ReceiptRead)
+}
+
+// SendRoomMessage sends a message to all members of a room.
+func (s *Session) SendRoomMessage(ctx context.Context, room, msg string) error {
+	return s.server.SendToRoom(ctx, &MessagePayload{
+		Stream:  s.ID,
+		From:    s.Nickname,
+		Room:    room,
+		Message: msg,
 	})
 }
 
+// CreateRoom creates a room and joins it.
+func (s *Session) CreateRoom(ctx context.Context, room string) error {
+	err := s.server.CreateRoom(ctx, room)
+	if err != nil {
+		return err
+	}
+	return s.JoinRoom(ctx, room)
+}
+
+// JoinRoom joins a room.
+func (s *Session) JoinRoom(ctx context.Context, room string) error {
+	err := s.server.JoinRoom(ctx, room, s.Nickname)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.rooms[room] = true
+	s.mutex.Unlock()
+	return nil
+}
+
+// LeaveRoom leaves a room.
+func (s *Session) LeaveRoom(ctx context.Context, room string) error {
+	err := s.server.LeaveRoom(ctx, room, s.Nickname)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	delete(s.rooms, room)
+	s.mutex.Unlock()
+	return nil
+}
+
+// RoomMembers returns the members of a room.
+func (s *Session) RoomMembers(ctx context.Context, room string) ([]string, error) {
+	return s.server.RoomMembers(ctx, room)
+}
+
+// History returns the messages exchanged with peer, older than the message of ID before.
+func (s *Session) History(ctx context.Context, peer string, before int64, limit int) ([]*db.Message, error) {
+	return s.server.History(ctx, s.Nickname, peer, before, limit)
+}
+
+// RoomHistory returns the messages sent to a room, older than the message of ID before.
+func (s *Session) RoomHistory(ctx context.Context, room string, before int64, limit int) ([]*db.Message, error) {
+	return s.server.RoomHistory(ctx, s.Nickname, room, before, limit)
+}
+
+// SetPresence sets the presence status of the user.
+func (s *Session) SetPresence(ctx context.Context, status PresenceStatus) error {
+	return s.server.SetPresence(ctx, s.Nickname, status)
+}
+
+// WatchPresence subscribes to the presence changes of some users.
+// It returns their current presence.
+func (s *Session) WatchPresence(ctx context.Context, nicknames []string) ([]*PresenceUpdate, error) {
+	return s.server.WatchPresence(ctx, s.Nickname, nicknames)
+}
+
+// UnwatchPresence unsubscribes from the presence changes of some users.
+func (s *Session) UnwatchPresence(ctx context.Context, nicknames []string) error {
+	return s.server.UnwatchPresence(ctx, s.Nickname, nicknames)
+}
+
+// SendSignal sends an ephemeral signal to someone.
+func (s *Session) SendSignal(ctx context.Context, to string, kind SignalKind) error {
+	return s.server.SendSignal(ctx, s.Nickname, to, kind)
+}
+
+// Dropped returns the number of messages dropped because the session did not
+// read them fast enough.
+func (s *Session) Dropped() uint64 {
+	return s.outbox.droppedCount()
+}
+
 // ReceiveMessage waits until it receives a message.
+// Returns io.EOF once the session is closed, or ErrSlowConsumer if it has been
+// disconnected because its outbox overflowed.
 func (s *Session) ReceiveMessage() (*MessagePayload, error) {
-	m, ok := <-s.recv
-	if !ok {
-		return nil, io.EOF
+	for {
+		s.mutex.Lock()
+		if len(s.pending) > 0 {
+			m := s.pending[0]
+			s.pending = s.pending[1:]
+			s.mutex.Unlock()
+			return m, nil
+		}
+		s.mutex.Unlock()
+
+		m, err := s.outbox.pop(s.reorder.deadline())
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			s.addPending(s.reorder.expire())
+			continue
+		}
+		s.addPending(s.reorder.push(m))
 	}
-	return m, nil
 }
 
-// Close closes the session.
+// Close closes the session, without deadline other than the db timeout of the server.
+// Use Server.CloseSession to bind it to a request.
 // The object cannot be reused after.
 func (s *Session) Close() error {
-	return s.server.CloseSession(s.Nickname)
+	ctx, cancel := s.server.backgroundContext()
+	defer cancel()
+
+	return s.server.CloseSession(ctx, s)
+}
+
+// joinedRooms returns the rooms joined during this session.
+func (s *Session) joinedRooms() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// adopt takes over the rooms of another session of the user, being closed.
+func (s *Session) adopt(other *Session) {
+	rooms := other.joinedRooms()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, room := range rooms {
+		s.rooms[room] = true
+	}
+}
+
+// addPending adds messages to deliver before the ones received on the channel.
+func (s *Session) addPending(msgs []*MessagePayload) {
+	s.mutex.Lock()
+	s.pending = append(s.pending, msgs...)
+	s.mutex.Unlock()
+}
+
+// nextSeq returns the next sequence number of the messages sent to a user.
+func (s *Session) nextSeq(to string) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seqs[to]++
+	return s.seqs[to]
+}
+
+// releaseSeq gives back the sequence number of a message which has not been sent,
+// so that the receiver does not wait for it. It is lost if a later one has been taken
+// meanwhile: the reorder buffer of the receiver then skips it after its timeout.
+func (s *Session) releaseSeq(to string, seq uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.seqs[to] == seq {
+		s.seqs[to]--
+	}
 }
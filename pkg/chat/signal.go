@@ -0,0 +1,141 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// SignalKind is the kind of an ephemeral signal
+type SignalKind string
+
+const (
+	// SignalTypingStarted means that the sender started typing a message
+	SignalTypingStarted SignalKind = "typing_started"
+	// SignalTypingStopped means that the sender stopped typing a message
+	SignalTypingStopped SignalKind = "typing_stopped"
+)
+
+var (
+	// ErrInvalidSignal is returned when a user sends an unknown signal.
+	ErrInvalidSignal = errors.New("invalid signal")
+)
+
+// Signal is an ephemeral message between two users.
+// Signals are lossy: they are never stored, queued nor retried, and they are
+// dropped if the receiver cannot take them immediately.
+type Signal struct {
+	Kind SignalKind
+}
+
+// WithTypingTimeout sets the delay after which a "typing started" signal
+// is automatically followed by a "typing stopped" one.
+func WithTypingTimeout(d time.Duration) Opt {
+	return func(s *Server) error {
+		if d <= 0 {
+			return errors.New("typing timeout must be positive")
+		}
+		s.typingTimeout = d
+		return nil
+	}
+}
+
+// SendSignal sends an ephemeral signal from a user to another one.
+// Typing signals expire: if no SignalTypingStopped is sent before the typing timeout,
+// the server sends it.
+func (s *Server) SendSignal(ctx context.Context, from, to string, kind SignalKind) error {
+	switch kind {
+	case SignalTypingStarted:
+		s.armTypingTimer(from, to)
+	case SignalTypingStopped:
+		s.stopTypingTimer(from, to)
+	default:
+		return ErrInvalidSignal
+	}
+	ctx, cancel := s.bind(ctx)
+	defer cancel()
+
+	return s.sendSignal(ctx, from, to, kind)
+}
+
+// sendSignal sends a signal without touching the typing timers.
+func (s *Server) sendSignal(ctx context.Context, from, to string, kind SignalKind) error {
+	return s.fanOut(ctx, &MessagePayload{
+		From:   from,
+		Signal: &Signal{Kind: kind},
+	}, []string{to})
+}
+
+// typingKey returns the key of the typing timer of a user towards another one.
+func typingKey(from, to string) string {
+	return from + ":" + to
+}
+
+// armTypingTimer (re)starts the timer that expires the typing signal of from to to.
+func (s *Server) armTypingTimer(from, to string) {
+	key := typingKey(from, to)
+
+	s.typingMutex.Lock()
+	defer s.typingMutex.Unlock()
+
+	if t := s.typingTimers[key]; t != nil {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(s.typingTimeout, func() {
+		s.typingMutex.Lock()
+		if s.typingTimers[key] != t {
+			// the timer has been re-armed or stopped in the meantime
+			s.typingMutex.Unlock()
+			return
+		}
+		delete(s.typingTimers, key)
+		s.typingMutex.Unlock()
+
+		ctx, cancel := s.backgroundContext()
+		defer cancel()
+		err := s.sendSignal(ctx, from, to, SignalTypingStopped)
+		if err != nil {
+			log.Debug(errors.Wrap(err, "typing expired"))
+		}
+	})
+	s.typingTimers[key] = t
+}
+
+// stopTypingTimer stops the timer that expires the typing signal of from to to.
+// Returns true if a timer was running.
+func (s *Server) stopTypingTimer(from, to string) bool {
+	key := typingKey(from, to)
+
+	s.typingMutex.Lock()
+	defer s.typingMutex.Unlock()
+
+	t := s.typingTimers[key]
+	if t == nil {
+		return false
+	}
+	t.Stop()
+	delete(s.typingTimers, key)
+	return true
+}
+
+// stopTyping stops all the typing signals of a user, e.g. when his session is closed.
+func (s *Server) stopTyping(ctx context.Context, from string) {
+	s.typingMutex.Lock()
+	var receivers []string
+	for key := range s.typingTimers {
+		if strings.HasPrefix(key, from+":") {
+			receivers = append(receivers, strings.TrimPrefix(key, from+":"))
+		}
+	}
+	s.typingMutex.Unlock()
+
+	for _, to := range receivers {
+		if s.stopTypingTimer(from, to) {
+			s.sendSignal(ctx, from, to, SignalTypingStopped)
+		}
+	}
+}
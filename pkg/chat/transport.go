@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrPeerUnreachable is returned by a Transport when the peer server cannot be reached.
+	ErrPeerUnreachable = errors.New("peer unreachable")
+	// ErrPeerUnavailable is returned by a Transport when the peer server, or a proxy
+	// in front of it, failed to handle a message.
+	ErrPeerUnavailable = errors.New("peer unavailable")
+	// ErrPeerRejected is returned by a Transport when the peer server refused a
+	// message, e.g. because it is not correctly signed.
+	ErrPeerRejected = errors.New("peer rejected message")
+)
+
+// DeliverFunc delivers a message received from a peer server to some of the
+// users connected on this server.
+// Returns ErrUserNotFound if the message has a single recipient who is not connected.
+type DeliverFunc = func(m *MessagePayload, recipients []string) error
+
+// Transport carries the messages between the chat servers of the cluster.
+type Transport interface {
+	// Deliver sends a message to the peer server of address peer, for the
+	// given recipients connected on it.
+	// Must return ErrUserNotFound if the peer answered that the single recipient
+	// is not connected on it, and give up once ctx is done.
+	Deliver(ctx context.Context, peer string, m *MessagePayload, recipients []string) error
+	// Listen receives the messages sent by the peers to the address addr and
+	// passes them to deliver. It blocks until Close is called.
+	Listen(addr string, deliver DeliverFunc) error
+	// Close stops listening.
+	Close() error
+}
+
+// PooledTransport is a Transport keeping connections to the peers.
+type PooledTransport interface {
+	Transport
+	// ForgetPeer closes the connections to a peer which left the cluster.
+	ForgetPeer(peer string)
+}
+
+// WithTransport sets the transport used to exchange messages with the other servers.
+// By default, an HTTPTransport is used.
+func WithTransport(t Transport) Opt {
+	return func(s *Server) error {
+		s.transport = t
+		return nil
+	}
+}
+
+// deliverFromPeer delivers a message received from another server.
+// The duplicates of the messages already delivered are dropped.
+func (s *Server) deliverFromPeer(m *MessagePayload, recipients []string) error {
+	recipients = s.dedup.filter(m, recipients)
+	if len(recipients) == 1 {
+		return s.sendToUser(recipients[0], addressedTo(m, recipients[0]))
+	}
+	s.sendToUsers(m, recipients)
+	return nil
+}
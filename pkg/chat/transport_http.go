@@ -0,0 +1,279 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// headers of the signature of the requests
+const (
+	headerClusterTimestamp = "X-Cluster-Timestamp"
+	headerClusterNonce     = "X-Cluster-Nonce"
+	headerClusterSignature = "X-Cluster-Signature"
+)
+
+// HTTPTransport is a Transport that posts the messages as JSON to the internal
+// HTTP server of the peers.
+// It implements TLSTransport, SigningTransport and AdminTransport.
+type HTTPTransport struct {
+	client  *http.Client
+	srv     http.Server
+	deliver DeliverFunc
+	scheme  string
+	tls     *tls.Config
+	signer  *ClusterSigner
+	admin   http.Handler
+}
+
+// httpTimeout bounds the requests to the peers
+const httpTimeout = 30 * time.Second
+
+// NewHTTPTransport creates a new HTTPTransport object.
+func NewHTTPTransport() *HTTPTransport {
+	return &HTTPTransport{
+		client: &http.Client{Timeout: httpTimeout},
+		scheme: "http",
+	}
+}
+
+// UseTLS serves and posts the messages over HTTPS.
+func (t *HTTPTransport) UseTLS(cfg *tls.Config) {
+	t.tls = cfg
+	t.scheme = "https"
+	t.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: cfg},
+		Timeout:   httpTimeout,
+	}
+}
+
+// UseSigner signs the posted messages and rejects the unsigned ones.
+func (t *HTTPTransport) UseSigner(s *ClusterSigner) {
+	t.signer = s
+}
+
+// ServeAdmin serves the admin endpoints on the internal HTTP server.
+func (t *HTTPTransport) ServeAdmin(h http.Handler) {
+	t.admin = h
+}
+
+// GetAdmin queries an admin endpoint of a peer.
+func (t *HTTPTransport) GetAdmin(peer, path, token string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, t.scheme+"://"+peer+path, nil)
+	if err != nil {
+		return errors.Wrap(err, "http request")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	ctx, cancel := context.WithTimeout(context.Background(), adminTimeout)
+	defer cancel()
+
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(ErrPeerUnreachable, err.Error())
+	}
+	defer resp.Body.Close()
+	err = statusError(resp.StatusCode)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "json decode")
+}
+
+// multiForwardPayload is the body of a message forwarded to another server
+// for several of its users.
+type multiForwardPayload struct {
+	Message    *MessagePayload
+	Recipients []string
+}
+
+// Deliver posts a message to a peer.
+// A message for a single user is posted to "/send", otherwise to "/send_many".
+func (t *HTTPTransport) Deliver(ctx context.Context, peer string, m *MessagePayload, recipients []string) error {
+	if len(recipients) == 1 && recipients[0] == m.To {
+		code, err := t.postJSON(ctx, peer, "/send", m)
+		if err != nil {
+			return err
+		}
+		if code == http.StatusNotFound {
+			return ErrUserNotFound
+		}
+		return statusError(code)
+	}
+
+	code, err := t.postJSON(ctx, peer, "/send_many", &multiForwardPayload{
+		Message:    m,
+		Recipients: recipients,
+	})
+	if err != nil {
+		return err
+	}
+	return statusError(code)
+}
+
+// statusError classifies the status code of the response of a peer.
+func statusError(code int) error {
+	switch {
+	case code >= 200 && code < 300:
+		return nil
+	case code >= 500:
+		return errors.Wrapf(ErrPeerUnavailable, "http status %d", code)
+	default:
+		return errors.Wrapf(ErrPeerRejected, "http status %d", code)
+	}
+}
+
+// Listen runs the internal HTTP server.
+func (t *HTTPTransport) Listen(addr string, deliver DeliverFunc) error {
+	t.deliver = deliver
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/send", t.verify(t.sendHandler))
+	mux.HandleFunc("/send_many", t.verify(t.sendManyHandler))
+	if t.admin != nil {
+		mux.Handle("/admin/", t.admin)
+	}
+
+	t.srv.Addr = addr
+	t.srv.Handler = mux
+
+	log.Infof("start cluster %s server on address \"%s\"", t.scheme, addr)
+	var err error
+	if t.tls != nil {
+		t.srv.TLSConfig = t.tls
+		err = t.srv.ListenAndServeTLS("", "")
+	} else {
+		err = t.srv.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close shutdowns the internal HTTP server.
+func (t *HTTPTransport) Close() error {
+	return t.srv.Shutdown(context.Background())
+}
+
+// verify rejects the requests that are not correctly signed, if a signer is set.
+func (t *HTTPTransport) verify(h http.HandlerFunc) http.HandlerFunc {
+	if t.signer == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Error(errors.Wrap(err, "read all"))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ts, _ := strconv.ParseInt(r.Header.Get(headerClusterTimestamp), 10, 64)
+		err = t.signer.Verify(signedRequest(r.URL.Path, body), &Signature{
+			Timestamp: ts,
+			Nonce:     r.Header.Get(headerClusterNonce),
+			MAC:       r.Header.Get(headerClusterSignature),
+		})
+		if err != nil {
+			log.Warn(errors.Wrapf(err, "request from \"%s\" rejected", r.RemoteAddr))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h(w, r)
+	}
+}
+
+// signedRequest returns what is signed in a request: its path and its body.
+func signedRequest(path string, body []byte) []byte {
+	return append([]byte(path+"\n"), body...)
+}
+
+// sendHandler is the HTTP handler used when another server needs this server to send a message
+// to a user (forwarding).
+func (t *HTTPTransport) sendHandler(w http.ResponseWriter, r *http.Request) {
+	m := MessagePayload{}
+	if !readJSON(w, r, &m) {
+		return
+	}
+
+	log.Infof("message to forward: %+v", &m)
+	err := t.deliver(&m, []string{m.To})
+	if err == ErrUserNotFound {
+		w.WriteHeader(http.StatusNotFound)
+	} else if err != nil {
+		log.Error(errors.Wrap(err, "deliver"))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// sendManyHandler is the HTTP handler used when another server needs this server
+// to deliver a message to several of its users.
+func (t *HTTPTransport) sendManyHandler(w http.ResponseWriter, r *http.Request) {
+	p := multiForwardPayload{}
+	if !readJSON(w, r, &p) {
+		return
+	}
+	if p.Message == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	t.deliver(p.Message, p.Recipients)
+}
+
+// readJSON reads the JSON body of a request into v.
+// On failure, it writes the appropriate status code and returns false.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error(errors.Wrap(err, "read all"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		log.Error(errors.Wrap(err, "unmarshal json:"))
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// postJSON sends v as JSON to the internal HTTP server of another chat server.
+// Returns the status code of the response.
+func (t *HTTPTransport) postJSON(ctx context.Context, server, path string, v interface{}) (int, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, errors.Wrap(err, "json marshal")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.scheme+"://"+server+path, bytes.NewBuffer(b))
+	if err != nil {
+		return 0, errors.Wrap(err, "http request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.signer != nil {
+		sig, err := t.signer.Sign(signedRequest(path, b))
+		if err != nil {
+			return 0, errors.Wrap(err, "sign")
+		}
+		req.Header.Set(headerClusterTimestamp, strconv.FormatInt(sig.Timestamp, 10))
+		req.Header.Set(headerClusterNonce, sig.Nonce)
+		req.Header.Set(headerClusterSignature, sig.MAC)
+	}
+
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, errors.Wrap(ErrPeerUnreachable, err.Error())
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
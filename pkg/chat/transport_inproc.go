@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"context"
+	"sync"
+)
+
+// InProcNetwork connects InProcTransports together, so several servers can run
+// in the same process without sockets (e.g. for tests).
+// Thread-safe.
+type InProcNetwork struct {
+	mutex sync.Mutex
+	// deliver functions of the listening transports, by address
+	peers map[string]DeliverFunc
+}
+
+// NewInProcNetwork creates a new InProcNetwork object.
+func NewInProcNetwork() *InProcNetwork {
+	return &InProcNetwork{
+		peers: make(map[string]DeliverFunc),
+	}
+}
+
+// Transport creates a new transport connected to the network.
+func (n *InProcNetwork) Transport() *InProcTransport {
+	return &InProcTransport{
+		network: n,
+		closed:  make(chan struct{}),
+	}
+}
+
+// InProcTransport is a Transport that delivers the messages with a function call.
+type InProcTransport struct {
+	network *InProcNetwork
+	addr    string
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// Deliver passes a copy of the message to the peer listening on the network.
+// Returns ErrPeerUnreachable if no peer listens on this address.
+func (t *InProcTransport) Deliver(ctx context.Context, peer string, m *MessagePayload, recipients []string) error {
+	t.network.mutex.Lock()
+	deliver := t.network.peers[peer]
+	t.network.mutex.Unlock()
+	if deliver == nil {
+		return ErrPeerUnreachable
+	}
+
+	// the peer must not share the message with the sender
+	cpy := *m
+	rcpts := append([]string(nil), recipients...)
+	return deliver(&cpy, rcpts)
+}
+
+// Listen registers the transport on the network until Close is called.
+func (t *InProcTransport) Listen(addr string, deliver DeliverFunc) error {
+	t.network.mutex.Lock()
+	select {
+	case <-t.closed:
+		t.network.mutex.Unlock()
+		return nil
+	default:
+	}
+	t.network.peers[addr] = deliver
+	t.addr = addr
+	t.network.mutex.Unlock()
+
+	<-t.closed
+	return nil
+}
+
+// Close unregisters the transport from the network.
+func (t *InProcTransport) Close() error {
+	t.once.Do(func() {
+		t.network.mutex.Lock()
+		delete(t.network.peers, t.addr)
+		t.network.mutex.Unlock()
+		close(t.closed)
+	})
+	return nil
+}
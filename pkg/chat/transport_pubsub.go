@@ -0,0 +1,211 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nouney/fluxracine/internal/db"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// PubSubTransport is a Transport that routes the messages through a publish/subscribe
+// system (e.g. Redis): each server subscribes to its own channel, and messages are
+// published to the channel of the receiving server. The servers do not need to
+// reach each other directly.
+//
+// Publishing is one-way: Deliver never returns ErrUserNotFound, a message for a user
+// who is not connected on the peer anymore is dropped by the peer.
+//
+// It implements SigningTransport. Encryption must be configured on the connection
+// to the publish/subscribe system.
+type PubSubTransport struct {
+	ps     db.PubSub
+	signer *ClusterSigner
+
+	mutex sync.Mutex
+	sub   db.Subscription
+	// closed by Close, stops Listen
+	done   chan struct{}
+	closed bool
+}
+
+const (
+	// delays before subscribing again to the channel of the server after an error,
+	// doubled after each failure
+	resubscribeMinBackoff = 100 * time.Millisecond
+	resubscribeMaxBackoff = 10 * time.Second
+)
+
+// NewPubSubTransport creates a new PubSubTransport object.
+func NewPubSubTransport(ps db.PubSub) *PubSubTransport {
+	return &PubSubTransport{ps: ps, done: make(chan struct{})}
+}
+
+// WithPubSubTransport routes the messages between the servers through a
+// publish/subscribe system instead of HTTP.
+func WithPubSubTransport(ps db.PubSub) Opt {
+	return WithTransport(NewPubSubTransport(ps))
+}
+
+// signedEnvelope is a published message with its signature.
+type signedEnvelope struct {
+	Payload   json.RawMessage
+	Signature *Signature
+}
+
+// UseSigner signs the published messages and rejects the unsigned ones.
+func (t *PubSubTransport) UseSigner(s *ClusterSigner) {
+	t.signer = s
+}
+
+// nodeChannel returns the channel of the server of address addr.
+func nodeChannel(addr string) string {
+	return "node:" + addr
+}
+
+// Deliver publishes a message on the channel of the peer.
+// Returns ErrPeerUnreachable if the peer does not listen to its channel, when the
+// publish/subscribe system can tell it.
+func (t *PubSubTransport) Deliver(ctx context.Context, peer string, m *MessagePayload, recipients []string) error {
+	b, err := json.Marshal(&multiForwardPayload{
+		Message:    m,
+		Recipients: recipients,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json marshal")
+	}
+	if t.signer != nil {
+		sig, err := t.signer.Sign(b)
+		if err != nil {
+			return errors.Wrap(err, "sign")
+		}
+		b, err = json.Marshal(&signedEnvelope{Payload: b, Signature: sig})
+		if err != nil {
+			return errors.Wrap(err, "json marshal")
+		}
+	}
+	n, err := t.ps.Publish(ctx, nodeChannel(peer), b)
+	if err != nil {
+		return errors.Wrap(ErrPeerUnreachable, errors.Wrap(err, "publish").Error())
+	}
+	if n == 0 {
+		return ErrPeerUnreachable
+	}
+	return nil
+}
+
+// Listen subscribes to the channel of this server and delivers the messages received.
+// It subscribes again after an error, until Close is called.
+func (t *PubSubTransport) Listen(addr string, deliver DeliverFunc) error {
+	channel := nodeChannel(addr)
+	backoff := resubscribeMinBackoff
+	for {
+		sub, err := t.subscribe(channel)
+		if err == nil && sub == nil {
+			// closed
+			return nil
+		}
+		if err == nil {
+			log.Infof("listen to cluster channel \"%s\"", channel)
+			err = t.receive(sub, deliver)
+			if err == nil {
+				return nil
+			}
+			sub.Close()
+			backoff = resubscribeMinBackoff
+		}
+		log.Error(errors.Wrapf(err, "cluster channel \"%s\", subscribe again in %s", channel, backoff))
+		select {
+		case <-t.done:
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > resubscribeMaxBackoff {
+			backoff = resubscribeMaxBackoff
+		}
+	}
+}
+
+// subscribe subscribes to a channel. It returns a nil subscription if the transport
+// has been closed.
+func (t *PubSubTransport) subscribe(channel string) (db.Subscription, error) {
+	sub, err := t.ps.Subscribe(context.Background(), channel)
+	if err != nil {
+		return nil, errors.Wrap(err, "subscribe")
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil, sub.Close()
+	}
+	t.sub = sub
+	return sub, nil
+}
+
+// receive delivers the messages received by a subscription until it is closed.
+func (t *PubSubTransport) receive(sub db.Subscription, deliver DeliverFunc) error {
+	for {
+		b, err := sub.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "receive")
+		}
+
+		b, err = t.open(b)
+		if err != nil {
+			log.Warn(errors.Wrap(err, "message from cluster channel rejected"))
+			continue
+		}
+		p := multiForwardPayload{}
+		err = json.Unmarshal(b, &p)
+		if err != nil || p.Message == nil {
+			log.Error(errors.Wrap(err, "invalid message from cluster channel"))
+			continue
+		}
+		err = deliver(p.Message, p.Recipients)
+		if err != nil && err != ErrUserNotFound {
+			log.Error(errors.Wrap(err, "deliver"))
+		}
+	}
+}
+
+// open checks the signature of a received message if a signer is set, and returns its payload.
+func (t *PubSubTransport) open(b []byte) ([]byte, error) {
+	if t.signer == nil {
+		return b, nil
+	}
+	env := signedEnvelope{}
+	err := json.Unmarshal(b, &env)
+	if err != nil {
+		return nil, errors.Wrap(err, "json unmarshal")
+	}
+	err = t.signer.Verify(env.Payload, env.Signature)
+	if err != nil {
+		return nil, err
+	}
+	return env.Payload, nil
+}
+
+// Close unsubscribes from the channel of this server.
+func (t *PubSubTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	close(t.done)
+	if t.sub == nil {
+		return nil
+	}
+	return t.sub.Close()
+}
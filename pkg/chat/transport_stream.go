@@ -0,0 +1,470 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// streamTimeout bounds the dial, and the write and read of a batch
+	streamTimeout = 5 * time.Second
+	// streamQueueSize is the number of messages waiting to be sent to a peer connection
+	streamQueueSize = 1024
+	// result sent back for a recipient who is not connected
+	streamResultNotFound = "not found"
+	// streamMaxFailures is the number of consecutive batches that failed to be sent
+	// to a peer after which its connections are closed and forgotten
+	streamMaxFailures = 3
+)
+
+// StreamTransport is a Transport that keeps long-lived TCP connections to the peers.
+// Messages bound for the same peer are coalesced into batches: a batch is sent when
+// it is full, or when the flush interval elapsed since its first message. The peer
+// answers with the outcome of each message of the batch.
+// It implements TLSTransport, SigningTransport and PooledTransport.
+type StreamTransport struct {
+	connsPerPeer  int
+	flushInterval time.Duration
+	maxBatch      int
+
+	tls    *tls.Config
+	signer *ClusterSigner
+
+	mutex    sync.Mutex
+	peers    map[string]*streamPeer
+	listener net.Listener
+	accepted map[net.Conn]bool
+	closed   bool
+	done     chan struct{}
+}
+
+// streamPeer is the pool of connections to a peer.
+type streamPeer struct {
+	conns []*streamConn
+	next  uint32
+	// consecutive batches which failed to be sent
+	failures int32
+	// closed when the peer is forgotten, stops its connections
+	done chan struct{}
+}
+
+// streamBatch is a batch of messages sent to a peer.
+// Items is the JSON encoded list of *multiForwardPayload, signed if a signer is set.
+type streamBatch struct {
+	Items     json.RawMessage
+	Signature *Signature `json:",omitempty"`
+}
+
+// streamReply is the answer of a peer to a batch: one result per message,
+// empty if the message has been delivered.
+type streamReply struct {
+	Results []string
+}
+
+// streamRequest is a message waiting to be sent, with the channel receiving its outcome.
+type streamRequest struct {
+	payload *multiForwardPayload
+	result  chan error
+}
+
+// NewStreamTransport creates a new StreamTransport object.
+// connsPerPeer is the number of connections opened to each peer, messages are sent
+// in batches of at most maxBatch messages, waiting at most flushInterval for more messages.
+func NewStreamTransport(connsPerPeer int, flushInterval time.Duration, maxBatch int) (*StreamTransport, error) {
+	if connsPerPeer <= 0 || maxBatch <= 0 || flushInterval < 0 {
+		return nil, errors.New("stream transport: invalid configuration")
+	}
+	return &StreamTransport{
+		connsPerPeer:  connsPerPeer,
+		flushInterval: flushInterval,
+		maxBatch:      maxBatch,
+		peers:         make(map[string]*streamPeer),
+		accepted:      make(map[net.Conn]bool),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// WithStreamTransport routes the messages between the servers through persistent
+// and batched TCP connections. See NewStreamTransport.
+func WithStreamTransport(connsPerPeer int, flushInterval time.Duration, maxBatch int) Opt {
+	return func(s *Server) error {
+		t, err := NewStreamTransport(connsPerPeer, flushInterval, maxBatch)
+		if err != nil {
+			return err
+		}
+		s.transport = t
+		return nil
+	}
+}
+
+// UseTLS encrypts the connections with TLS.
+func (t *StreamTransport) UseTLS(cfg *tls.Config) {
+	t.tls = cfg
+}
+
+// UseSigner signs the batches sent and rejects the unsigned ones.
+func (t *StreamTransport) UseSigner(s *ClusterSigner) {
+	t.signer = s
+}
+
+// Deliver queues a message for a peer and waits for its outcome.
+// If ctx is done meanwhile, the message may still be sent.
+func (t *StreamTransport) Deliver(ctx context.Context, peer string, m *MessagePayload, recipients []string) error {
+	conn, err := t.conn(peer)
+	if err != nil {
+		return err
+	}
+	done := conn.peer.done
+
+	r := &streamRequest{
+		payload: &multiForwardPayload{
+			Message:    m,
+			Recipients: recipients,
+		},
+		result: make(chan error, 1),
+	}
+	select {
+	case conn.queue <- r:
+	case <-t.done:
+		return ErrPeerUnreachable
+	case <-done:
+		return ErrPeerUnreachable
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-r.result:
+		return err
+	case <-t.done:
+		return ErrPeerUnreachable
+	case <-done:
+		return ErrPeerUnreachable
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// conn returns one of the connections to a peer, creating them if needed.
+func (t *StreamTransport) conn(peer string) (*streamConn, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil, ErrPeerUnreachable
+	}
+	p := t.peers[peer]
+	if p == nil {
+		p = &streamPeer{
+			conns: make([]*streamConn, t.connsPerPeer),
+			done:  make(chan struct{}),
+		}
+		for i := range p.conns {
+			p.conns[i] = &streamConn{
+				t:     t,
+				peer:  p,
+				addr:  peer,
+				queue: make(chan *streamRequest, streamQueueSize),
+			}
+			go p.conns[i].run()
+		}
+		t.peers[peer] = p
+	}
+	i := atomic.AddUint32(&p.next, 1)
+	return p.conns[int(i)%len(p.conns)], nil
+}
+
+// ForgetPeer closes the connections to a peer and fails the messages queued for it.
+// They are opened again by the next message sent to it.
+func (t *StreamTransport) ForgetPeer(peer string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.forget(peer, t.peers[peer])
+}
+
+// forget removes p, the pool of connections to peer, if it is still in use.
+// Must be called with the mutex held.
+func (t *StreamTransport) forget(peer string, p *streamPeer) {
+	if p == nil || t.peers[peer] != p {
+		return
+	}
+	delete(t.peers, peer)
+	close(p.done)
+}
+
+// sent records the outcome of a batch sent to a peer, which is forgotten after
+// too many consecutive failures.
+func (t *StreamTransport) sent(peer string, p *streamPeer, err error) {
+	if err == nil {
+		atomic.StoreInt32(&p.failures, 0)
+		return
+	}
+	if atomic.AddInt32(&p.failures, 1) < streamMaxFailures {
+		return
+	}
+	log.Warnf("stream: %d batches failed to be sent to \"%s\", forget it", streamMaxFailures, peer)
+	t.mutex.Lock()
+	t.forget(peer, p)
+	t.mutex.Unlock()
+}
+
+// Listen accepts the connections of the peers and delivers the messages they send.
+func (t *StreamTransport) Listen(addr string, deliver DeliverFunc) error {
+	var l net.Listener
+	var err error
+	if t.tls != nil {
+		l, err = tls.Listen("tcp", addr, t.tls)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return l.Close()
+	}
+	t.listener = l
+	t.mutex.Unlock()
+
+	log.Infof("start cluster stream server on address \"%s\"", addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-t.done:
+				return nil
+			default:
+				return errors.Wrap(err, "accept")
+			}
+		}
+		t.mutex.Lock()
+		t.accepted[conn] = true
+		t.mutex.Unlock()
+		go t.serve(conn, deliver)
+	}
+}
+
+// serve reads the batches sent by a peer on a connection and answers them.
+func (t *StreamTransport) serve(conn net.Conn, deliver DeliverFunc) {
+	defer func() {
+		conn.Close()
+		t.mutex.Lock()
+		delete(t.accepted, conn)
+		t.mutex.Unlock()
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+	for {
+		batch := streamBatch{}
+		err := dec.Decode(&batch)
+		if err != nil {
+			log.Debug(errors.Wrap(err, "stream: read batch"))
+			return
+		}
+
+		items, err := t.openBatch(&batch)
+		if err != nil {
+			log.Warn(errors.Wrapf(err, "stream: batch from \"%s\" rejected", conn.RemoteAddr()))
+			return
+		}
+
+		reply := streamReply{Results: make([]string, len(items))}
+		for i, item := range items {
+			if item == nil || item.Message == nil {
+				reply.Results[i] = "invalid message"
+				continue
+			}
+			err = deliver(item.Message, item.Recipients)
+			if err == ErrUserNotFound {
+				reply.Results[i] = streamResultNotFound
+			} else if err != nil {
+				reply.Results[i] = err.Error()
+			}
+		}
+		err = enc.Encode(&reply)
+		if err != nil {
+			log.Debug(errors.Wrap(err, "stream: write reply"))
+			return
+		}
+	}
+}
+
+// openBatch checks the signature of a batch, if a signer is set, and decodes its messages.
+func (t *StreamTransport) openBatch(batch *streamBatch) ([]*multiForwardPayload, error) {
+	if t.signer != nil {
+		err := t.signer.Verify(batch.Items, batch.Signature)
+		if err != nil {
+			return nil, err
+		}
+	}
+	items := []*multiForwardPayload{}
+	err := json.Unmarshal(batch.Items, &items)
+	if err != nil {
+		return nil, errors.Wrap(err, "json unmarshal")
+	}
+	return items, nil
+}
+
+// Close stops listening, closes all the connections and fails the queued messages.
+func (t *StreamTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	close(t.done)
+	for conn := range t.accepted {
+		conn.Close()
+	}
+	if t.listener != nil {
+		return t.listener.Close()
+	}
+	return nil
+}
+
+// streamConn is a connection to a peer, with its queue of messages to send.
+type streamConn struct {
+	t     *StreamTransport
+	peer  *streamPeer
+	addr  string
+	queue chan *streamRequest
+	conn  net.Conn
+	enc   *json.Encoder
+	dec   *json.Decoder
+}
+
+// run sends the queued messages by batches until the transport is closed or the
+// peer forgotten.
+// A single batch is in flight at a time: messages queued meanwhile make the next batch.
+func (c *streamConn) run() {
+	defer c.close()
+
+	for {
+		var batch []*streamRequest
+		select {
+		case r := <-c.queue:
+			batch = append(batch, r)
+		case <-c.t.done:
+			c.failQueue()
+			return
+		case <-c.peer.done:
+			c.failQueue()
+			return
+		}
+
+		timer := time.NewTimer(c.t.flushInterval)
+	collect:
+		for len(batch) < c.t.maxBatch {
+			select {
+			case r := <-c.queue:
+				batch = append(batch, r)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		results, err := c.send(batch)
+		if err != nil {
+			log.Debug(errors.Wrapf(err, "stream: send batch to \"%s\"", c.addr))
+			c.close()
+		}
+		c.t.sent(c.addr, c.peer, err)
+		for i, r := range batch {
+			switch {
+			case err != nil:
+				r.result <- errors.Wrap(ErrPeerUnreachable, err.Error())
+			case results[i] == "":
+				r.result <- nil
+			case results[i] == streamResultNotFound:
+				r.result <- ErrUserNotFound
+			default:
+				r.result <- errors.Wrap(ErrPeerUnavailable, results[i])
+			}
+		}
+	}
+}
+
+// send writes a batch on the connection, dialing it if needed, and reads the results.
+func (c *streamConn) send(batch []*streamRequest) ([]string, error) {
+	if c.conn == nil {
+		dialer := &net.Dialer{Timeout: streamTimeout}
+		var conn net.Conn
+		var err error
+		if c.t.tls != nil {
+			conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.t.tls)
+		} else {
+			conn, err = dialer.Dial("tcp", c.addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.enc = json.NewEncoder(conn)
+		c.dec = json.NewDecoder(bufio.NewReader(conn))
+	}
+
+	items := make([]*multiForwardPayload, len(batch))
+	for i, r := range batch {
+		items[i] = r.payload
+	}
+	raw, err := json.Marshal(items)
+	if err != nil {
+		return nil, errors.Wrap(err, "json marshal")
+	}
+	b := streamBatch{Items: raw}
+	if c.t.signer != nil {
+		b.Signature, err = c.t.signer.Sign(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "sign")
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(streamTimeout))
+	err = c.enc.Encode(&b)
+	if err != nil {
+		return nil, err
+	}
+	reply := streamReply{}
+	err = c.dec.Decode(&reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Results) != len(batch) {
+		return nil, errors.Errorf("%d results for %d messages", len(reply.Results), len(batch))
+	}
+	return reply.Results, nil
+}
+
+// close closes the network connection, it is dialed again by the next batch.
+func (c *streamConn) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// failQueue fails the messages left in the queue.
+func (c *streamConn) failQueue() {
+	for {
+		select {
+		case r := <-c.queue:
+			r.result <- ErrPeerUnreachable
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package chat
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// freeAddr returns a local address on which nothing listens.
+func freeAddr(tb testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// benchmarkTransport measures the delivery of a message from a transport to another
+// one listening on the same host, by concurrent senders: ns/op is the inverse of the
+// number of messages per second, allocs/op include both sides.
+func benchmarkTransport(b *testing.B, newTransport func() Transport) {
+	addr := freeAddr(b)
+	receiver := newTransport()
+	go receiver.Listen(addr, func(m *MessagePayload, recipients []string) error {
+		return nil
+	})
+	defer receiver.Close()
+	sender := newTransport()
+	defer sender.Close()
+
+	m := &MessagePayload{ID: "0123456789abcdef", From: "alice", To: "bob", Message: "hello"}
+	recipients := []string{"bob"}
+	ctx := context.Background()
+	// wait for the receiver to listen
+	deadline := time.Now().Add(5 * time.Second)
+	for sender.Deliver(ctx, addr, m, recipients) != nil {
+		if time.Now().After(deadline) {
+			b.Fatal("receiver not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.ReportAllocs()
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := sender.Deliver(ctx, addr, m, recipients)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkHTTPTransport(b *testing.B) {
+	benchmarkTransport(b, func() Transport {
+		return NewHTTPTransport()
+	})
+}
+
+func BenchmarkStreamTransport(b *testing.B) {
+	benchmarkTransport(b, func() Transport {
+		t, err := NewStreamTransport(2, time.Millisecond, 64)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return t
+	})
+}
+
+func BenchmarkStreamTransportNoBatch(b *testing.B) {
+	benchmarkTransport(b, func() Transport {
+		t, err := NewStreamTransport(2, 0, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return t
+	})
+}
+
+func TestStreamTransportForgetsUnreachablePeer(t *testing.T) {
+	tr, err := NewStreamTransport(1, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	addr := freeAddr(t)
+	m := &MessagePayload{ID: "0123456789abcdef", From: "alice", To: "bob", Message: "hello"}
+	for i := 0; i < streamMaxFailures; i++ {
+		err = tr.Deliver(context.Background(), addr, m, []string{"bob"})
+		if errors.Cause(err) != ErrPeerUnreachable {
+			t.Fatalf("delivery %d: expected ErrPeerUnreachable, got %v", i, err)
+		}
+	}
+
+	tr.mutex.Lock()
+	_, ok := tr.peers[addr]
+	tr.mutex.Unlock()
+	if ok {
+		t.Errorf("peer \"%s\" not forgotten after %d failures", addr, streamMaxFailures)
+	}
+}
+
+func TestStreamTransportForgetPeer(t *testing.T) {
+	tr, err := NewStreamTransport(2, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	addr := freeAddr(t)
+	conn, err := tr.conn(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.ForgetPeer(addr)
+
+	select {
+	case <-conn.peer.done:
+	default:
+		t.Fatal("connections of the forgotten peer not stopped")
+	}
+	tr.mutex.Lock()
+	_, ok := tr.peers[addr]
+	tr.mutex.Unlock()
+	if ok {
+		t.Errorf("peer \"%s\" not forgotten", addr)
+	}
+}
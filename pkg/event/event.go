@@ -23,6 +23,36 @@ const (
 	EventUserSendMessage
 	// EventUserReceiveMessage is triggered when an user receives a message from another
 	EventUserReceiveMessage
+	// EventUserCreateRoom is triggered when an user creates a room
+	EventUserCreateRoom
+	// EventUserJoinRoom is triggered when an user joins a room
+	EventUserJoinRoom
+	// EventUserLeaveRoom is triggered when an user leaves a room
+	EventUserLeaveRoom
+	// EventUserListRoomMembers is triggered when an user asks for the members of a room
+	EventUserListRoomMembers
+	// EventUserSendRoomMessage is triggered when an user sends a message to a room
+	EventUserSendRoomMessage
+	// EventUserGetHistory is triggered when an user asks for the history of a conversation
+	EventUserGetHistory
+	// EventUserSetPresence is triggered when an user changes his presence status
+	EventUserSetPresence
+	// EventUserWatchPresence is triggered when an user subscribes to the presence of others
+	EventUserWatchPresence
+	// EventUserUnwatchPresence is triggered when an user unsubscribes from the presence of others
+	EventUserUnwatchPresence
+	// EventUserReceivePresence is triggered when the presence of a watched user changes
+	EventUserReceivePresence
+	// EventUserReadMessage is triggered when an user has read a message
+	EventUserReadMessage
+	// EventUserReceiveReceipt is triggered when an user receives a receipt for a message he sent
+	EventUserReceiveReceipt
+	// EventUserTyping is triggered when an user starts or stops typing a message to another
+	EventUserTyping
+	// EventUserReceiveTyping is triggered when someone starts or stops typing a message to an user
+	EventUserReceiveTyping
+	// EventUserReceiveReconnect is triggered when the server asks an user to reconnect elsewhere
+	EventUserReceiveReconnect
 )
 
 // Handler is a callback that responses to an event